@@ -1,20 +1,22 @@
 package app
 
 import (
-	"database/sql"
-	"fmt"
-	"log"
+	"context"
+	"crypto/rand"
+	"errors"
+	"expvar"
 	"net/http"
+	"sync"
 
 	"github.com/ThePianoDentist/fancy-a-brew/app/middleware"
 	ws "github.com/ThePianoDentist/fancy-a-brew/deprecatedws"
 
-	"github.com/ThePianoDentist/fancy-a-brew/fcm_client"
-
 	"github.com/ThePianoDentist/fancy-a-brew/app_context"
-	_ "github.com/lib/pq"
-
-	//_ "github.com/jackc/pgx/v4"
+	"github.com/ThePianoDentist/fancy-a-brew/config"
+	"github.com/ThePianoDentist/fancy-a-brew/migrations"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/jackc/pgx/v4/pgxpool"
 
 	handlers "github.com/ThePianoDentist/fancy-a-brew/app/handlers"
 
@@ -25,38 +27,180 @@ import (
 
 type App struct {
 	Router *mux.Router
-	DB     *sql.DB
-	appCtx *app_context.AppContext
+	// only served on http.admin_addr, if it's set
+	AdminRouter *mux.Router
+	DB          *pgxpool.Pool
+	Scheduler   *RoundScheduler
+	appCtx      *app_context.AppContext
+	workers     sync.WaitGroup
 }
 
-func NewApp(lgr *zap.Logger, user, password, dbname string) *App {
-	connectionString := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", user, password, dbname)
-
-	var err error
-	db, err := sql.Open("postgres", connectionString)
+func NewApp(lgr *zap.Logger, cfg *config.Config) (*App, error) {
+	if cfg.SessionSecret == "" && !cfg.Dev {
+		return nil, errors.New("session_secret must be set (or set dev to generate a throwaway one)")
+	}
+	db, store, err := newStore(lgr, cfg.DB)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	hub := ws.NewHub(lgr)
 
-	fcmClient := fcm_client.NewFCMController(lgr)
-	appCtx := &app_context.AppContext{Hub: hub, Lgr: lgr, DB: db, FcmController: fcmClient}
+	notif, err := NewNotifier(lgr, cfg.Notifier.Kind, cfg.Notifier.FCMCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := []byte(cfg.SessionSecret)
+	if len(secret) == 0 {
+		// only allowed in dev. every session is invalidated whenever the server restarts
+		lgr.Warn("no session secret set, generating a random one")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	sessions := middleware.NewSessionSigner(secret)
+
+	outbox := notifier.NewOutbox(lgr, store, notif)
+	outbox.Workers = cfg.Notifier.Workers
+	outbox.BatchSize = cfg.Notifier.BatchSize
+	outbox.MaxAttempts = cfg.Notifier.MaxAttempts
+	outbox.RetryBackoff = cfg.Notifier.RetryBackoff.Duration()
+	outbox.MaxRetryBackoff = cfg.Notifier.MaxRetryBackoff.Duration()
+	outbox.PollInterval = cfg.Notifier.PollInterval.Duration()
+	outbox.SendTimeout = cfg.Notifier.SendTimeout.Duration()
+	appCtx := &app_context.AppContext{Hub: hub, Lgr: lgr, Store: store, Cfg: cfg, Notifier: notif, Outbox: outbox, Sessions: sessions}
+
+	scheduler := NewRoundScheduler(appCtx)
+	scheduler.RoundTimeout = cfg.Rounds.Timeout.Duration()
+	scheduler.ReminderLead = cfg.Rounds.ReminderLead.Duration()
+	scheduler.Interval = cfg.Rounds.CheckInterval.Duration()
 
 	router := mux.NewRouter()
-	// db shouldnt be in both app and appctx. prob needs to stay in appctx as handlers need to access it
-	app := &App{Router: router, appCtx: appCtx, DB: db}
+	// DB is nil with the memory store. handlers only ever go through appCtx.Store
+	app := &App{Router: router, appCtx: appCtx, DB: db, Scheduler: scheduler}
 	app.setupRouter()
-	return app
+	return app, nil
+}
+
+// Postgres (migrated/checked as configured) or in-memory, depending on cfg.Driver
+func newStore(lgr *zap.Logger, cfg config.DBConfig) (*pgxpool.Pool, storage.Store, error) {
+	if cfg.Driver == "memory" {
+		lgr.Warn("using in-memory store, nothing will survive a restart")
+		return nil, storage.NewMemoryStore(), nil
+	}
+	ctx := context.Background()
+	pool, err := OpenDB(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrator, err := migrations.NewMigrator(pool, lgr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.AutoMigrate {
+		if _, err := migrator.Up(ctx); err != nil {
+			return nil, nil, err
+		}
+	} else if err := migrator.CheckExtensions(ctx); err != nil {
+		return nil, nil, err
+	}
+	return pool, storage.NewPostgresStore(pool, cfg.QueryTimeout.Duration()), nil
+}
+
+// Connects straight away, so a wrong password/host fails at startup rather than on the first request
+func OpenDB(ctx context.Context, cfg config.DBConfig) (*pgxpool.Pool, error) {
+	poolCfg, err := pgxpool.ParseConfig(cfg.ConnectionString())
+	if err != nil {
+		return nil, err
+	}
+	poolCfg.MaxConns = cfg.MaxConns
+	poolCfg.MinConns = cfg.MinConns
+	poolCfg.MaxConnLifetime = cfg.ConnMaxLifetime.Duration()
+	return pgxpool.ConnectConfig(ctx, poolCfg)
 }
 
-func (a *App) Run(addr string) {
+// Serves until ctx is cancelled (or the listener fails). Then stops accepting connections, gives in-flight requests
+// and background workers up to http.shutdown_timeout to finish, and closes the DB pool.
+func (a *App) Run(ctx context.Context) error {
 	// prob need smarter way of authing user/kettle.
 	//a.Router.HandleFunc("/kettles/{kettleId}/{userId}/offer/", app.PostOffer).Methods(http.MethodPost)
 	//a.Router.HandleFunc("/kettles/{kettleId}/{userId}/request/", app.PostDrinkRequest).Methods(http.MethodPost)
 	// Need to auth to a kettle. (Is a webserver needed, or can peer-2-peea.Router. that sounds hard.)
-	if err := http.ListenAndServe(addr, a.Router); err != nil {
-		log.Fatal("error running server: ", zap.Error(err))
+	cfg := a.appCtx.Cfg
+	lgr := a.appCtx.Lgr
+	servers := []*http.Server{a.newServer(cfg.ListenAddr, a.Router)}
+	if cfg.HTTP.AdminAddr != "" {
+		servers = append(servers, a.newServer(cfg.HTTP.AdminAddr, a.AdminRouter))
+	}
+
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	a.startWorker(workersCtx, a.Scheduler.Run)
+	a.startWorker(workersCtx, a.appCtx.Outbox.Run)
+
+	serveErr := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			lgr.Info("listening", zap.String("addr", s.Addr))
+			serveErr <- s.ListenAndServe()
+		}(s)
+	}
+	var err error
+	select {
+	case err = <-serveErr:
+		// e.g. address already in use. still tidy up the workers and pool below
+	case <-ctx.Done():
+		lgr.Info("shutting down")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout.Duration())
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			lgr.Error("error draining in-flight requests", zap.String("addr", s.Addr), zap.Error(err))
+		}
+	}
+	// handlers can leave work for the workers, so they're only stopped once the handlers are done
+	stopWorkers()
+	workersDone := make(chan struct{})
+	go func() {
+		a.workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-shutdownCtx.Done():
+		lgr.Error("gave up waiting for background workers to finish")
+	}
+	if a.DB != nil {
+		a.DB.Close()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
 	}
+	return err
+}
+
+func (a *App) newServer(addr string, handler http.Handler) *http.Server {
+	cfg := a.appCtx.Cfg.HTTP
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout.Duration(),
+		WriteTimeout: cfg.WriteTimeout.Duration(),
+		IdleTimeout:  cfg.IdleTimeout.Duration(),
+		ErrorLog:     zap.NewStdLog(a.appCtx.Lgr),
+	}
+}
+
+// Runs f in the background until Run shuts down. Run waits for f to return before closing the DB pool.
+func (a *App) startWorker(ctx context.Context, f func(context.Context)) {
+	a.workers.Add(1)
+	go func() {
+		defer a.workers.Done()
+		f(ctx)
+	}()
 }
 
 func (a *App) setupRouter() {
@@ -65,22 +209,62 @@ func (a *App) setupRouter() {
 		func(w http.ResponseWriter, r *http.Request) {
 			return
 		})
-	a.Router.HandleFunc("/", handlers.IndexHandler)
-	a.Router.HandleFunc("/health/", handlers.HealthHandler)
+	// health checks come from load balancers/orchestrators doing plain GETs, so they sit outside the JSON-only api
+	a.Router.Methods(http.MethodGet).Path("/health/live").Handler(a.ctxHandler(handlers.GetHealthLive))
+	a.Router.Methods(http.MethodGet).Path("/health/ready").Handler(a.ctxHandler(handlers.GetHealthReady))
+	// old liveness path, kept so existing checks don't break
+	a.Router.Methods(http.MethodGet).Path("/health/").Handler(a.ctxHandler(handlers.GetHealthLive))
+	a.Router.Use(middleware.AccessControl(a.appCtx.Cfg.CORSOrigins))
+
+	// expvar counters (notifications sent/retried/failed, pruned tokens) plus go runtime stats.
+	// not for the public, so it's on its own router and only served on the admin listener
+	a.AdminRouter = mux.NewRouter()
+	a.AdminRouter.Methods(http.MethodGet).Path("/debug/vars").Handler(expvar.Handler())
+
+	api := a.Router.PathPrefix("/").Subrouter()
+	api.Use(middleware.RequireJsonContentType)
+	api.HandleFunc("/", handlers.IndexHandler)
 	//a.Router.HandleFunc("/ws/", handlers.WebsocketHandler(a.appCtx.Hub))
 	//a.Router.HandleFunc("/ws/new/{kettleName}/{userName}", handlers.WebsocketHandlerNew(hub, lgr))
 	//a.Router.HandleFunc("/ws/{kettleId}/{userName}", handlers.WebsocketHandler(hub))
 	//a.Router.HandleFunc("/ws/new/{kettleName}/{userName}", handlers.WebsocketHandlerNew(hub, lgr))
-	a.Router.HandleFunc("/users/{userId}/", handlers.GetUser).Methods(http.MethodGet)
-	a.Router.Methods(http.MethodPost).Path("/users/").Handler(&app_context.CtxHandler{a.appCtx, handlers.PostUser})
-	a.Router.HandleFunc("/kettles/{kettleId}/", handlers.GetKettle).Methods(http.MethodGet)
+	api.Methods(http.MethodGet).Path("/users/{userId}/").Handler(a.ctxHandler(handlers.GetUser))
+	api.Methods(http.MethodGet).Path("/users/{userId}/stats/").Handler(a.authed(handlers.GetUserStats))
+	api.Methods(http.MethodPost).Path("/users/").Handler(a.ctxHandler(handlers.PostUser))
+	api.Methods(http.MethodPost).Path("/sessions/request/").Handler(a.ctxHandler(handlers.PostSignInRequest))
+	api.Methods(http.MethodPost).Path("/sessions/").Handler(a.ctxHandler(handlers.PostSession))
+	api.Methods(http.MethodGet).Path("/users/{userId}/devices/").Handler(a.authed(handlers.GetUserDevices))
+	api.Methods(http.MethodPost).Path("/users/{userId}/devices/").Handler(a.authed(handlers.PostUserDevice))
+	api.Methods(http.MethodDelete).Path("/users/{userId}/devices/{deviceId}/").Handler(a.authed(handlers.DeleteUserDevice))
+	api.Methods(http.MethodGet).Path("/kettles/{kettleId}/").Handler(a.ctxHandler(handlers.GetKettle))
+	api.Methods(http.MethodGet).Path("/kettles/{kettleId}/stats/").Handler(a.authed(handlers.GetKettleStats))
 	// maybe should just be get with query params for location + radius....however that would mean it'd be cacheable.
 	// and might miss new kettles added.
-	a.Router.Methods(http.MethodPost).Path("/kettles/list/").Handler(&app_context.CtxHandler{a.appCtx, handlers.GetHotSteamyKettlesInYourArea})
-	a.Router.Methods(http.MethodPost).Path("/kettles/").Handler(&app_context.CtxHandler{a.appCtx, handlers.PostKettle})
-	a.Router.Methods(http.MethodPost).Path("/kettles/{kettleId}/offer/").Handler(&app_context.CtxHandler{a.appCtx, handlers.PostOfferBrew})
-	a.Router.Methods(http.MethodPost).Path("/kettles/{kettleId}/response/").Handler(&app_context.CtxHandler{a.appCtx, handlers.PostBrewResponse})
-	a.Router.Methods(http.MethodPost).Path("/kettles/{kettleId}/finished/").Handler(&app_context.CtxHandler{a.appCtx, handlers.PostFinished})
-	a.Router.Use(middleware.AccessControl)
-	a.Router.Use(middleware.RequireJsonContentType)
+	api.Methods(http.MethodPost).Path("/kettles/list/").Handler(a.ctxHandler(handlers.GetHotSteamyKettlesInYourArea))
+	api.Methods(http.MethodPost).Path("/kettles/").Handler(a.authed(handlers.PostKettle))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/members/").Handler(a.authed(handlers.PostKettleMember))
+	api.Methods(http.MethodDelete).Path("/kettles/{kettleId}/members/").Handler(a.authed(handlers.DeleteKettleMember))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/members/{userId}/").Handler(a.authed(handlers.PostKettleMemberInvite))
+	api.Methods(http.MethodGet).Path("/kettles/{kettleId}/menu/").Handler(a.ctxHandler(handlers.GetKettleMenu))
+	api.Methods(http.MethodPut).Path("/kettles/{kettleId}/menu/").Handler(a.authed(handlers.PutKettleMenu))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/menu/stock/").Handler(a.authed(handlers.PostMenuStock))
+	api.Methods(http.MethodGet).Path("/kettles/{kettleId}/rota/").Handler(a.authed(handlers.GetKettleRota))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/rounds/request/").Handler(a.authed(handlers.PostRoundRequest))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/offer/").Handler(a.authed(handlers.PostOfferBrew))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/response/").Handler(a.authed(handlers.PostBrewResponse))
+	api.Methods(http.MethodGet).Path("/kettles/{kettleId}/rounds/current/").Handler(a.authed(handlers.GetCurrentRound))
+	api.Methods(http.MethodGet).Path("/kettles/{kettleId}/rounds/current/sheet/").Handler(a.authed(handlers.GetBrewSheet))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/brewing/").Handler(a.authed(handlers.PostStartBrewing))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/requests/{requestId}/done/").Handler(a.authed(handlers.PostDrinkDone))
+	api.Methods(http.MethodDelete).Path("/kettles/{kettleId}/requests/{requestId}/done/").Handler(a.authed(handlers.DeleteDrinkDone))
+	api.Methods(http.MethodPost).Path("/kettles/{kettleId}/finished/").Handler(a.authed(handlers.PostFinished))
+}
+
+func (a *App) ctxHandler(f func(*app_context.AppContext, http.ResponseWriter, *http.Request)) http.Handler {
+	return &app_context.CtxHandler{AppCtx: a.appCtx, CtxHandlerFunc: f}
+}
+
+// Same as ctxHandler, but the caller must have a valid session token
+func (a *App) authed(f func(*app_context.AppContext, http.ResponseWriter, *http.Request)) http.Handler {
+	return middleware.RequireSession(a.appCtx.Lgr, a.appCtx.Sessions)(a.ctxHandler(f))
 }
@@ -0,0 +1,529 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	handlers "github.com/ThePianoDentist/fancy-a-brew/app/handlers"
+	"github.com/ThePianoDentist/fancy-a-brew/config"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+)
+
+// The whole router on top of the memory store, with notifications recorded rather than sent.
+// The outbox is running, so anything queued gets "sent" shortly after.
+func newTestApp(t *testing.T) (*App, *notifier.RecordingNotifier) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.DB.Driver = "memory"
+	cfg.Notifier.Kind = notifier.KindMemory
+	cfg.SessionSecret = "test secret"
+	a, err := NewApp(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.appCtx.Outbox.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return a, a.appCtx.Notifier.(*notifier.RecordingNotifier)
+}
+
+// Waits for the outbox to have sent at least want notifications to token, and returns them all.
+func waitForSent(t *testing.T, sent *notifier.RecordingNotifier, token string, want int) []notifier.Notification {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := sent.SentTo(token)
+		if len(got) >= want || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type testResp struct {
+	Code   int
+	Status string          `json:"status"`
+	Data   json.RawMessage `json:"data"`
+	Error  string          `json:"error"`
+}
+
+// session is sent as the bearer token if it's not empty. body is marshalled to JSON if it's not nil.
+func do(t *testing.T, a *App, method, path, session string, body interface{}) testResp {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	// like the app, only say it's JSON when there could be a body
+	if method != http.MethodGet && method != http.MethodDelete {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if session != "" {
+		req.Header.Set("Authorization", "Bearer "+session)
+	}
+	rec := httptest.NewRecorder()
+	a.Router.ServeHTTP(rec, req)
+	resp := testResp{Code: rec.Code}
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s: bad json response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return resp
+}
+
+// fails the test unless the response had the expected code, then decodes data into out (if it's not nil)
+func expect(t *testing.T, resp testResp, code int, out interface{}) {
+	t.Helper()
+	if resp.Code != code {
+		t.Fatalf("expected %d, got %d: %s", code, resp.Code, resp.Error)
+	}
+	if out != nil {
+		if err := json.Unmarshal(resp.Data, out); err != nil {
+			t.Fatalf("bad response data %s: %v", resp.Data, err)
+		}
+	}
+}
+
+type testUser struct {
+	UserId  uuid.UUID
+	Token   string
+	Session string
+}
+
+func newTestUser(t *testing.T, a *App, nickname, theUsual string, long, lat float64) testUser {
+	t.Helper()
+	u := handlers.PostUserReq{FirebaseToken: "phone-" + nickname, DefaultNickname: nickname, TheUsual: theUsual, LastKnownLong: long, LastKnownLat: lat}
+	var created struct {
+		UserId       uuid.UUID `json:"userId"`
+		SessionToken string    `json:"sessionToken"`
+	}
+	expect(t, do(t, a, http.MethodPost, "/users/", "", u), http.StatusCreated, &created)
+	return testUser{UserId: created.UserId, Token: u.FirebaseToken, Session: created.SessionToken}
+}
+
+func newTestKettle(t *testing.T, a *App, owner testUser, long, lat float64) uuid.UUID {
+	t.Helper()
+	k := storage.Kettle{WirelessId: "kettle-" + uuid.New().String(), Name: "office", Long: long, Lat: lat}
+	var created struct {
+		KettleId uuid.UUID `json:"kettleId"`
+	}
+	expect(t, do(t, a, http.MethodPost, "/kettles/", owner.Session, k), http.StatusCreated, &created)
+	return created.KettleId
+}
+
+func TestOfferResponseFlow(t *testing.T) {
+	a, sent := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "earl grey", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "coffee", -0.1, 51.5)
+	carol := newTestUser(t, a, "carol", "green tea", -0.1, 51.5)
+	// miles away, shouldn't hear about anything
+	dave := newTestUser(t, a, "dave", "tea", 2.35, 48.85)
+	kettleId := newTestKettle(t, a, alice, -0.1, 51.5)
+	kettlePath := "/kettles/" + kettleId.String()
+
+	var round storage.Round
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/offer/", bob.Session, nil), http.StatusOK, &round)
+	if round.MakerId != bob.UserId || round.State != storage.RoundOffered {
+		t.Fatalf("expected an offered round for bob, got %+v", round)
+	}
+	for _, u := range []testUser{alice, carol} {
+		offers := waitForSent(t, sent, u.Token, 1)
+		if len(offers) != 1 || offers[0].Data["type"] != "offer" || offers[0].Data["roundId"] != round.RoundId.String() {
+			t.Errorf("expected %s to be offered a drink once, got %+v", u.Token, offers)
+		}
+	}
+	if got := sent.SentTo(bob.Token); len(got) != 0 {
+		t.Errorf("maker shouldn't be offered their own round, got %+v", got)
+	}
+	if got := sent.SentTo(dave.Token); len(got) != 0 {
+		t.Errorf("dave is too far away to be offered, got %+v", got)
+	}
+
+	resp := do(t, a, http.MethodPost, kettlePath+"/offer/", carol.Session, nil)
+	expect(t, resp, http.StatusConflict, nil)
+	if !strings.Contains(resp.Error, "bob") {
+		t.Errorf("conflict should say bob is making, got %q", resp.Error)
+	}
+
+	var dr storage.DrinkRequest
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/response/", alice.Session, map[string]interface{}{"Choice": "hot chocolate"}), http.StatusOK, &dr)
+	if dr.Choice != "hot chocolate" || dr.RoundId != round.RoundId {
+		t.Errorf("unexpected drink request %+v", dr)
+	}
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/response/", carol.Session, map[string]interface{}{"TheUsualTicked": true}), http.StatusOK, &dr)
+	if dr.Choice != "green tea" {
+		t.Errorf("the usual should be carol's usual, got %q", dr.Choice)
+	}
+	requests := waitForSent(t, sent, bob.Token, 2)
+	if len(requests) != 2 {
+		t.Fatalf("expected bob to hear about 2 drink requests, got %+v", requests)
+	}
+	// the outbox sends concurrently, so they can arrive in either order
+	choices := map[string]string{}
+	for _, n := range requests {
+		if n.Data["type"] != "drinkrequest" {
+			t.Errorf("unexpected notification to the maker %+v", n.Data)
+		}
+		choices[n.Data["name"]] = n.Data["choice"]
+	}
+	if choices["alice"] != "hot chocolate" || choices["carol"] != "green tea" {
+		t.Errorf("expected alice's hot chocolate and carol's green tea, got %v", choices)
+	}
+
+	var current struct {
+		Round    storage.Round          `json:"round"`
+		Requests []storage.DrinkRequest `json:"requests"`
+	}
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rounds/current/", "", nil), http.StatusUnauthorized, nil)
+	// not a member and not in the round
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rounds/current/", dave.Session, nil), http.StatusForbidden, nil)
+	// bob isn't a member either, but is making it
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rounds/current/", bob.Session, nil), http.StatusOK, &current)
+	if current.Round.State != storage.RoundCollecting || len(current.Requests) != 2 {
+		t.Errorf("expected a collecting round with 2 requests, got %+v", current)
+	}
+
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/brewing/", alice.Session, nil), http.StatusForbidden, nil)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/brewing/", bob.Session, nil), http.StatusOK, &round)
+	if round.State != storage.RoundBrewing {
+		t.Errorf("expected brewing, got %s", round.State)
+	}
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/response/", dave.Session, map[string]interface{}{"Choice": "tea"}), http.StatusConflict, nil)
+
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/finished/", bob.Session, nil), http.StatusOK, &round)
+	if round.State != storage.RoundDelivered {
+		t.Errorf("expected delivered, got %s", round.State)
+	}
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rounds/current/", alice.Session, nil), http.StatusNotFound, nil)
+
+	// kettle's free again
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/offer/", carol.Session, nil), http.StatusOK, &round)
+}
+
+func TestOfferTakeOver(t *testing.T) {
+	a, sent := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "tea", -0.1, 51.5)
+	carol := newTestUser(t, a, "carol", "coffee", -0.1, 51.5)
+	kettlePath := "/kettles/" + newTestKettle(t, a, alice, -0.1, 51.5).String()
+
+	var first, second storage.Round
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/offer/", alice.Session, nil), http.StatusOK, &first)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/response/", carol.Session, map[string]string{"Choice": "coffee"}), http.StatusOK, nil)
+	// alice's round is fresh, so nobody can take it over. being a member doesn't change that
+	for _, join := range []bool{false, true} {
+		if join {
+			expect(t, do(t, a, http.MethodPost, kettlePath+"/members/", bob.Session, nil), http.StatusCreated, nil)
+		}
+		resp := do(t, a, http.MethodPost, kettlePath+"/offer/", bob.Session, map[string]bool{"TakeOver": true})
+		expect(t, resp, http.StatusConflict, nil)
+		if !strings.Contains(resp.Error, "can't be taken over until it's been left for 5 minutes") {
+			t.Errorf("conflict should say when it can be taken over, got %q", resp.Error)
+		}
+	}
+
+	a.appCtx.Cfg.Rounds.TakeOverAfter = config.Duration(10 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/offer/", bob.Session, map[string]bool{"TakeOver": true}), http.StatusOK, &second)
+	if second.MakerId != bob.UserId || second.RoundId == first.RoundId {
+		t.Fatalf("expected bob to have taken over with a new round, got %+v", second)
+	}
+	old, err := a.appCtx.Store.GetRound(context.Background(), first.RoundId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.State != storage.RoundCancelled {
+		t.Errorf("taken over round should be cancelled, got %s", old.State)
+	}
+	for _, u := range []testUser{alice, carol} {
+		var takenOver []notifier.Notification
+		deadline := time.Now().Add(2 * time.Second)
+		for len(takenOver) == 0 && time.Now().Before(deadline) {
+			for _, m := range sent.SentTo(u.Token) {
+				if m.Data["type"] == notifier.TypeRoundTakenOver {
+					takenOver = append(takenOver, m)
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if len(takenOver) != 1 || takenOver[0].Data["roundId"] != first.RoundId.String() || takenOver[0].Data["newMakerNickname"] != "bob" {
+			t.Errorf("expected %s to be told bob took over, got %+v", u.Token, takenOver)
+		}
+	}
+}
+
+func TestStaleRoundTakeOver(t *testing.T) {
+	a, _ := newTestApp(t)
+	a.appCtx.Cfg.Rounds.TakeOverAfter = config.Duration(10 * time.Millisecond)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "tea", -0.1, 51.5)
+	kettlePath := "/kettles/" + newTestKettle(t, a, alice, -0.1, 51.5).String()
+
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/offer/", alice.Session, nil), http.StatusOK, nil)
+	time.Sleep(20 * time.Millisecond)
+	// not a member, but alice has left it long enough
+	var round storage.Round
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/offer/", bob.Session, map[string]bool{"TakeOver": true}), http.StatusOK, &round)
+	if round.MakerId != bob.UserId {
+		t.Errorf("expected bob to have taken over, got %+v", round)
+	}
+}
+
+func TestExpiredRoundNotifiesDrinkersNotMaker(t *testing.T) {
+	a, sent := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "coffee", -0.1, 51.5)
+	kettlePath := "/kettles/" + newTestKettle(t, a, alice, -0.1, 51.5).String()
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/offer/", alice.Session, nil), http.StatusOK, nil)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/response/", alice.Session, map[string]string{"Choice": "tea"}), http.StatusOK, nil)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/response/", bob.Session, map[string]string{"Choice": "coffee"}), http.StatusOK, nil)
+
+	a.Scheduler.expireRounds(context.Background(), time.Now().Add(time.Minute))
+	// the offer, then the expiry
+	toBob := waitForSent(t, sent, bob.Token, 2)
+	if len(toBob) != 2 || toBob[1].Data["type"] != notifier.TypeRoundExpired {
+		t.Errorf("expected bob to be told the round expired, got %+v", toBob)
+	}
+	for _, n := range sent.SentTo(alice.Token) {
+		if n.Data["type"] == notifier.TypeRoundExpired {
+			t.Errorf("alice made the round, so shouldn't be told it expired")
+		}
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "coffee", -0.1, 51.5)
+	kettlePath := "/kettles/" + newTestKettle(t, a, alice, -0.1, 51.5).String()
+	aliceStats := "/users/" + alice.UserId.String() + "/stats/"
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		session string
+		code    int
+	}{
+		{"offer without a session", http.MethodPost, kettlePath + "/offer/", "", http.StatusUnauthorized},
+		{"offer with a forged session", http.MethodPost, kettlePath + "/offer/", "not.valid", http.StatusUnauthorized},
+		{"offer on no such kettle", http.MethodPost, "/kettles/" + uuid.New().String() + "/offer/", alice.Session, http.StatusNotFound},
+		{"kettle id isn't a uuid", http.MethodGet, "/kettles/kettle/", "", http.StatusBadRequest},
+		{"no such kettle", http.MethodGet, "/kettles/" + uuid.New().String() + "/", "", http.StatusNotFound},
+		{"no such user", http.MethodGet, "/users/" + uuid.New().String() + "/", "", http.StatusNotFound},
+		{"respond with nobody making", http.MethodPost, kettlePath + "/response/", alice.Session, http.StatusConflict},
+		{"finish with nobody making", http.MethodPost, kettlePath + "/finished/", alice.Session, http.StatusConflict},
+		{"user stats without a session", http.MethodGet, aliceStats, "", http.StatusUnauthorized},
+		{"someone else's user stats", http.MethodGet, aliceStats, bob.Session, http.StatusForbidden},
+		{"own user stats", http.MethodGet, aliceStats, alice.Session, http.StatusOK},
+		{"kettle stats without a session", http.MethodGet, kettlePath + "/stats/", "", http.StatusUnauthorized},
+		{"kettle stats for a non-member", http.MethodGet, kettlePath + "/stats/", bob.Session, http.StatusForbidden},
+		{"kettle stats for a member", http.MethodGet, kettlePath + "/stats/", alice.Session, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body interface{}
+			if tt.method == http.MethodPost {
+				body = map[string]string{"Choice": "tea"}
+			}
+			resp := do(t, a, tt.method, tt.path, tt.session, body)
+			if resp.Code != tt.code {
+				t.Errorf("expected %d, got %d: %s", tt.code, resp.Code, resp.Error)
+			}
+			// including the ones from middleware, errors are all the usual JSON shape
+			if resp.Code >= 400 && (resp.Status != "error" || resp.Error == "") {
+				t.Errorf("expected a JSON error, got %+v", resp)
+			}
+		})
+	}
+}
+
+func TestDeviceCantBeStolen(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "tea", -0.1, 51.5)
+
+	devicesPath := "/users/" + bob.UserId.String() + "/devices/"
+	expect(t, do(t, a, http.MethodPost, devicesPath, bob.Session, map[string]string{"firebaseToken": alice.Token}), http.StatusConflict, nil)
+	expect(t, do(t, a, http.MethodPost, "/users/", bob.Session, map[string]string{"FirebaseToken": alice.Token}), http.StatusConflict, nil)
+	owner, err := a.appCtx.Store.GetUserIdFromToken(context.Background(), alice.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != alice.UserId {
+		t.Errorf("alice's token should still be hers, got %s", owner)
+	}
+	// their own token is fine
+	expect(t, do(t, a, http.MethodPost, devicesPath, bob.Session, map[string]string{"firebaseToken": bob.Token}), http.StatusCreated, nil)
+}
+
+func TestKettleOnlyChangedByMembers(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "tea", -0.1, 51.5)
+	k := storage.Kettle{WirelessId: "kettle-" + uuid.New().String(), Name: "office", Long: -0.1, Lat: 51.5}
+	var created struct {
+		KettleId uuid.UUID `json:"kettleId"`
+	}
+	expect(t, do(t, a, http.MethodPost, "/kettles/", alice.Session, k), http.StatusCreated, &created)
+
+	k.Name, k.NotifyMode = "bob's", storage.NotifyMembers
+	expect(t, do(t, a, http.MethodPost, "/kettles/", bob.Session, k), http.StatusForbidden, nil)
+	got, err := a.appCtx.Store.GetKettle(context.Background(), created.KettleId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "office" || got.NotifyMode != storage.NotifyNearby {
+		t.Errorf("bob isn't a member so shouldn't have changed the kettle, got %+v", got)
+	}
+	k.Name = "kitchen"
+	expect(t, do(t, a, http.MethodPost, "/kettles/", alice.Session, k), http.StatusCreated, nil)
+}
+
+func TestJoinKettle(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "tea", -0.1, 51.5)
+	// miles away
+	dave := newTestUser(t, a, "dave", "tea", 2.35, 48.85)
+	kettlePath := "/kettles/" + newTestKettle(t, a, alice, -0.1, 51.5).String()
+
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/members/", dave.Session, nil), http.StatusForbidden, nil)
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rota/", dave.Session, nil), http.StatusForbidden, nil)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/members/", bob.Session, nil), http.StatusCreated, nil)
+	// only members can add people
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/members/"+dave.UserId.String()+"/", dave.Session, nil), http.StatusForbidden, nil)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/members/"+dave.UserId.String()+"/", bob.Session, nil), http.StatusCreated, nil)
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rota/", dave.Session, nil), http.StatusOK, nil)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/members/"+uuid.New().String()+"/", bob.Session, nil), http.StatusNotFound, nil)
+}
+
+func TestSignUpWithSomeoneElsesToken(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+
+	resp := do(t, a, http.MethodPost, "/users/", "", map[string]string{"FirebaseToken": alice.Token, "DefaultNickname": "mallory"})
+	expect(t, resp, http.StatusConflict, nil)
+	if len(resp.Data) != 0 && string(resp.Data) != "null" {
+		t.Errorf("no session should be handed out, got %s", resp.Data)
+	}
+
+	// with her session it's just alice updating herself
+	var updated struct {
+		UserId uuid.UUID `json:"userId"`
+	}
+	expect(t, do(t, a, http.MethodPost, "/users/", alice.Session, map[string]string{"FirebaseToken": alice.Token, "TheUsual": "coffee"}), http.StatusCreated, &updated)
+	if updated.UserId != alice.UserId {
+		t.Errorf("expected alice %s, got %s", alice.UserId, updated.UserId)
+	}
+}
+
+func TestSignBackIn(t *testing.T) {
+	a, sent := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+
+	expect(t, do(t, a, http.MethodPost, "/sessions/request/", "", map[string]string{"FirebaseToken": "phone-nobody"}), http.StatusNotFound, nil)
+	expect(t, do(t, a, http.MethodPost, "/sessions/request/", "", map[string]string{"FirebaseToken": alice.Token}), http.StatusAccepted, nil)
+	got := waitForSent(t, sent, alice.Token, 1)
+	if len(got) != 1 || got[0].Message.Data["type"] != notifier.TypeSignIn {
+		t.Fatalf("expected a sign in notification, got %+v", got)
+	}
+	code := got[0].Message.Data["code"]
+
+	// codes and sessions can't stand in for each other
+	expect(t, do(t, a, http.MethodGet, "/users/"+alice.UserId.String()+"/devices/", code, nil), http.StatusUnauthorized, nil)
+	expect(t, do(t, a, http.MethodPost, "/sessions/", "", map[string]string{"Code": alice.Session}), http.StatusUnauthorized, nil)
+	expect(t, do(t, a, http.MethodPost, "/sessions/", "", map[string]string{"Code": code + "x"}), http.StatusUnauthorized, nil)
+
+	var session struct {
+		UserId       uuid.UUID `json:"userId"`
+		SessionToken string    `json:"sessionToken"`
+	}
+	expect(t, do(t, a, http.MethodPost, "/sessions/", "", map[string]string{"Code": code}), http.StatusCreated, &session)
+	if session.UserId != alice.UserId {
+		t.Errorf("expected alice %s, got %s", alice.UserId, session.UserId)
+	}
+	expect(t, do(t, a, http.MethodGet, "/users/"+alice.UserId.String()+"/devices/", session.SessionToken, nil), http.StatusOK, nil)
+}
+
+func TestSessionSecretRequiredOutsideDev(t *testing.T) {
+	cfg := config.Default()
+	cfg.DB.Driver = "memory"
+	cfg.Notifier.Kind = notifier.KindMemory
+	if _, err := NewApp(zap.NewNop(), cfg); err == nil {
+		t.Fatal("expected an error without a session secret")
+	}
+	cfg.Dev = true
+	if _, err := NewApp(zap.NewNop(), cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugVarsOnlyOnAdminRouter(t *testing.T) {
+	a, _ := newTestApp(t)
+	rec := httptest.NewRecorder()
+	a.Router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if rec.Code == http.StatusOK || strings.Contains(rec.Body.String(), "notifications_sent") {
+		t.Errorf("/debug/vars shouldn't be on the public router, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	a.AdminRouter.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "notifications_sent") {
+		t.Errorf("expected the expvar counters from the admin router, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestBodylessRequestsDontNeedJsonContentType(t *testing.T) {
+	a, _ := newTestApp(t)
+	alice := newTestUser(t, a, "alice", "tea", -0.1, 51.5)
+	bob := newTestUser(t, a, "bob", "coffee", -0.1, 51.5)
+	kettlePath := "/kettles/" + newTestKettle(t, a, alice, -0.1, 51.5).String()
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/offer/", alice.Session, nil), http.StatusOK, nil)
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/response/", bob.Session, map[string]string{"Choice": "coffee"}), http.StatusOK, nil)
+
+	req := httptest.NewRequest(http.MethodGet, kettlePath+"/rounds/current/sheet/?format=text", nil)
+	req.Header.Set("Authorization", "Bearer "+alice.Session)
+	rec := httptest.NewRecorder()
+	a.Router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "coffee") {
+		t.Errorf("expected the plain text brew sheet, got %d %q", rec.Code, rec.Body.String())
+	}
+	carol := newTestUser(t, a, "carol", "tea", -0.1, 51.5)
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rounds/current/sheet/", "", nil), http.StatusUnauthorized, nil)
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rounds/current/sheet/", carol.Session, nil), http.StatusForbidden, nil)
+	expect(t, do(t, a, http.MethodGet, kettlePath+"/rounds/current/sheet/", bob.Session, nil), http.StatusOK, nil)
+
+	expect(t, do(t, a, http.MethodPost, kettlePath+"/members/", bob.Session, nil), http.StatusCreated, nil)
+	expect(t, do(t, a, http.MethodDelete, kettlePath+"/members/", bob.Session, nil), http.StatusOK, nil)
+
+	// anything with a body still has to be JSON
+	req = httptest.NewRequest(http.MethodPost, kettlePath+"/response/", strings.NewReader("Choice=tea"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+bob.Session)
+	rec = httptest.NewRecorder()
+	a.Router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for a form post, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+// free text orders that aren't just the name of a drink all end up under this
+const otherDrinks = "other"
+
+// Everything the maker needs to make the round in one go, counted up by drink then by exactly how it's wanted.
+type BrewSheet struct {
+	RoundId    uuid.UUID `json:"roundId"`
+	KettleName string    `json:"kettleName"`
+	State      string    `json:"state"`
+	Total      int       `json:"total"`
+	// most wanted first
+	Drinks []BrewSheetDrink `json:"drinks"`
+}
+
+type BrewSheetDrink struct {
+	// e.g. "tea", or "other" for free text the sheet can't make sense of
+	Drink    string             `json:"drink"`
+	Count    int                `json:"count"`
+	Variants []BrewSheetVariant `json:"variants"`
+}
+
+// Drinks wanted exactly the same way
+type BrewSheetVariant struct {
+	// e.g. "strong tea, oat milk, 1 sugar"
+	Description string `json:"description"`
+	// nil if they're all free text orders
+	Order *storage.DrinkOrder `json:"order"`
+	Count int                 `json:"count"`
+	// nicknames, in the order they asked
+	Who []string `json:"who"`
+	// how many of these the maker has ticked off
+	Done int `json:"done"`
+}
+
+func NewBrewSheet(round storage.Round, kettleName string, requests []storage.DrinkRequest) BrewSheet {
+	sheet := BrewSheet{RoundId: round.RoundId, KettleName: kettleName, State: string(round.State), Total: len(requests), Drinks: make([]BrewSheetDrink, 0)}
+	drinkIdx := make(map[string]int)
+	variantIdx := make(map[string]int)
+	for _, dr := range requests {
+		drink, description := otherDrinks, strings.ToLower(strings.TrimSpace(dr.Choice))
+		if dr.Order != nil {
+			drink, description = dr.Order.Drink.Label(), dr.Order.String()
+		} else if dt, ok := storage.ParseDrinkType(description); ok {
+			drink = dt.Label()
+		}
+		// grouped by what the maker reads, so free text "Tea" and a plain structured tea are one line, not two "tea"s
+		key := drink + "\x00" + strings.ToLower(description)
+
+		i, ok := drinkIdx[drink]
+		if !ok {
+			i = len(sheet.Drinks)
+			drinkIdx[drink] = i
+			sheet.Drinks = append(sheet.Drinks, BrewSheetDrink{Drink: drink, Variants: make([]BrewSheetVariant, 0)})
+		}
+		d := &sheet.Drinks[i]
+		d.Count++
+		j, ok := variantIdx[key]
+		if !ok {
+			j = len(d.Variants)
+			variantIdx[key] = j
+			d.Variants = append(d.Variants, BrewSheetVariant{Description: description, Order: dr.Order, Who: make([]string, 0)})
+		}
+		v := &d.Variants[j]
+		if v.Order == nil {
+			v.Order = dr.Order
+		}
+		v.Count++
+		v.Who = append(v.Who, dr.Nickname)
+		if dr.DoneAt != nil {
+			v.Done++
+		}
+	}
+
+	// stable so ties stay in the order they were asked for
+	sort.SliceStable(sheet.Drinks, func(i, j int) bool { return sheet.Drinks[i].Count > sheet.Drinks[j].Count })
+	for _, d := range sheet.Drinks {
+		sort.SliceStable(d.Variants, func(i, j int) bool { return d.Variants[i].Count > d.Variants[j].Count })
+	}
+	return sheet
+}
+
+// e.g.
+//
+//	Brew sheet for Office: 4 drinks
+//
+//	3x tea
+//	  2x tea, oat milk (Bob, Cat)
+//	  1x strong tea, 1 sugar (Dan)
+//	1x other
+//	  1x peppermint please (Eve)
+func (s BrewSheet) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Brew sheet for %s: %s\n", s.KettleName, storage.Plural(s.Total, "drink"))
+	if s.Total == 0 {
+		b.WriteString("\nNobody's asked for anything yet\n")
+		return b.String()
+	}
+	b.WriteString("\n")
+	for _, d := range s.Drinks {
+		fmt.Fprintf(&b, "%dx %s\n", d.Count, d.Drink)
+		for _, v := range d.Variants {
+			done := ""
+			if v.Done == v.Count {
+				done = " - done"
+			} else if v.Done > 0 {
+				done = fmt.Sprintf(" - %d done", v.Done)
+			}
+			fmt.Fprintf(&b, "  %dx %s (%s)%s\n", v.Count, v.Description, strings.Join(v.Who, ", "), done)
+		}
+	}
+	return b.String()
+}
+
+// The current round's orders counted up for the maker. ?format=text gives a plain text version for sharing.
+func GetBrewSheet(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	kettleId, round, requests, ok := sessionUserActiveRound(appCtx, w, r)
+	if !ok {
+		return
+	}
+	kettle, err := appCtx.Store.GetKettle(r.Context(), kettleId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	sheet := NewBrewSheet(round, kettle.Name, requests)
+	if r.URL.Query().Get("format") == "text" {
+		utils.TextResponse(appCtx.Lgr, w, http.StatusOK, sheet.Text())
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, sheet)
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+)
+
+func TestNewBrewSheet(t *testing.T) {
+	round := storage.Round{RoundId: uuid.New(), State: storage.RoundCollecting}
+	oatTea := storage.DrinkOrder{Drink: storage.DrinkTea, Milk: storage.MilkOat}
+	requests := []storage.DrinkRequest{
+		{Nickname: "Amy", Choice: "Tea"},
+		{Nickname: "Bob", Choice: "tea", Order: &storage.DrinkOrder{Drink: storage.DrinkTea}},
+		{Nickname: "Cat", Choice: oatTea.String(), Order: &oatTea},
+		{Nickname: "Dan", Choice: oatTea.String(), Order: &oatTea},
+		{Nickname: "Eve", Choice: "peppermint please"},
+	}
+	sheet := NewBrewSheet(round, "Office", requests)
+
+	if sheet.Total != 5 || len(sheet.Drinks) != 2 {
+		t.Fatalf("expected 5 drinks in 2 groups, got %+v", sheet)
+	}
+	tea := sheet.Drinks[0]
+	if tea.Drink != "tea" || tea.Count != 4 {
+		t.Fatalf("expected 4 teas first, got %+v", tea)
+	}
+	if len(tea.Variants) != 2 {
+		t.Fatalf("free text tea and a plain structured tea should be one variant, got %+v", tea.Variants)
+	}
+	plain := tea.Variants[0]
+	if plain.Description != "tea" || plain.Count != 2 || strings.Join(plain.Who, ",") != "Amy,Bob" || plain.Order == nil {
+		t.Errorf("unexpected plain tea variant %+v", plain)
+	}
+	if oat := tea.Variants[1]; oat.Description != "tea, oat milk" || oat.Count != 2 {
+		t.Errorf("unexpected oat tea variant %+v", oat)
+	}
+	if other := sheet.Drinks[1]; other.Drink != otherDrinks || other.Count != 1 {
+		t.Errorf("expected the peppermint under other, got %+v", other)
+	}
+
+	text := sheet.Text()
+	if !strings.HasPrefix(text, "Brew sheet for Office: 5 drinks\n") || strings.Count(text, "x tea (") != 1 {
+		t.Errorf("unexpected text sheet:\n%s", text)
+	}
+}
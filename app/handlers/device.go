@@ -0,0 +1,105 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+type PostUserDeviceReq struct {
+	FirebaseToken string `json:"firebaseToken"`
+	// e.g. "Pixel 5". optional
+	Name string `json:"name"`
+}
+
+func GetUserDevices(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	userId, ok := sessionUserIsPathUser(appCtx, w, r)
+	if !ok {
+		return
+	}
+	devices, err := appCtx.Store.GetUserDevices(r.Context(), userId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, devices)
+}
+
+// Adds another device (or a refreshed token for this one) that the caller's notifications should go to.
+func PostUserDevice(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	userId, ok := sessionUserIsPathUser(appCtx, w, r)
+	if !ok {
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	var d PostUserDeviceReq
+	if err := decoder.Decode(&d); err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if d.FirebaseToken == "" {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "firebaseToken can't be empty", nil)
+		return
+	}
+	device := storage.Device{UserId: userId, FirebaseToken: d.FirebaseToken, Name: d.Name}
+	if err := appCtx.Store.RegisterDevice(r.Context(), &device); errors.Is(err, storage.ErrDeviceTaken) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "That device is registered to someone else. They need to remove it first", err)
+		return
+	} else if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusCreated, device)
+}
+
+// Stops notifications going to the device, e.g. on logout.
+func DeleteUserDevice(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	userId, ok := sessionUserIsPathUser(appCtx, w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	deviceId, err := uuid.Parse(vars["deviceId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid deviceId. Got: %s", vars["deviceId"]), err)
+		return
+	}
+	removed, err := appCtx.Store.RemoveDevice(r.Context(), userId, deviceId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	if !removed {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such device", nil)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, struct{}{})
+}
+
+// For /users/{userId}/... endpoints where you can only touch your own stuff. Writes a 400/403 and returns false if
+// the path's userId isn't the caller.
+func sessionUserIsPathUser(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	vars := mux.Vars(r)
+	pathUserId, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid userId. Got: %s", vars["userId"]), err)
+		return uuid.UUID{}, false
+	}
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return uuid.UUID{}, false
+	}
+	if userId != pathUserId {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "You can only manage your own devices", nil)
+		return uuid.UUID{}, false
+	}
+	return userId, true
+}
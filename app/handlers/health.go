@@ -1,7 +1,79 @@
 package app
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"time"
 
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	return
+	"go.uber.org/zap"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+// Set at build time, e.g.
+// go build -ldflags "-X github.com/ThePianoDentist/fancy-a-brew/app/handlers.Version=$(git describe --always)"
+var Version = "dev"
+
+// load balancers tend to give up after a few seconds, so don't make them wait on a hung DB for the full query timeout
+const readinessTimeout = 2 * time.Second
+
+type HealthCheck struct {
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthResp struct {
+	Status  string                 `json:"status"`
+	Version string                 `json:"version"`
+	Checks  map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+// The process is up and serving. Deliberately doesn't touch the DB, so a DB blip doesn't get every instance restarted.
+func GetHealthLive(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	utils.JSONResponse(appCtx.Lgr, w, http.StatusOK, HealthResp{Status: "ok", Version: Version})
+}
+
+// Whether this instance can usefully take traffic. 503 if the DB or PostGIS isn't there.
+// The notifier is only reported on, a log/memory notifier still counts as ready.
+func GetHealthReady(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	resp := HealthResp{Status: "ok", Version: Version, Checks: make(map[string]HealthCheck)}
+
+	if err := appCtx.Store.Ping(ctx); err != nil {
+		appCtx.Lgr.Warn("readiness check: db unreachable", zap.Error(err))
+		// the full error is logged above, it could give away more about the db than a public endpoint should
+		resp.Checks["db"] = HealthCheck{Ok: false, Detail: "unreachable"}
+	} else {
+		resp.Checks["db"] = HealthCheck{Ok: true}
+	}
+
+	postgisVersion, err := appCtx.Store.PostGISVersion(ctx)
+	switch {
+	case err != nil:
+		appCtx.Lgr.Warn("readiness check: postgis unavailable", zap.Error(err))
+		resp.Checks["postgis"] = HealthCheck{Ok: false, Detail: "unavailable"}
+	case postgisVersion == "":
+		resp.Checks["postgis"] = HealthCheck{Ok: true, Detail: "not used by this store"}
+	default:
+		resp.Checks["postgis"] = HealthCheck{Ok: true, Detail: postgisVersion}
+	}
+
+	kind := appCtx.Notifier.Kind()
+	notifierCheck := HealthCheck{Ok: true, Detail: kind}
+	if kind != notifier.KindFCM {
+		notifierCheck.Detail = kind + " (notifications are not being delivered to devices)"
+	}
+	resp.Checks["notifier"] = notifierCheck
+
+	code := http.StatusOK
+	for _, check := range resp.Checks {
+		if !check.Ok {
+			resp.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	utils.JSONResponse(appCtx.Lgr, w, code, resp)
 }
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+)
+
+// a store whose db has gone away
+type unreachableStore struct {
+	storage.Store
+}
+
+var errUnreachable = errors.New("dial tcp 10.0.0.12:5432: connect: connection refused (user=brew database=brew)")
+
+func (unreachableStore) Ping(ctx context.Context) error {
+	return errUnreachable
+}
+
+func (unreachableStore) PostGISVersion(ctx context.Context) (string, error) {
+	return "", errUnreachable
+}
+
+func TestHealthReadyDoesntLeakErrors(t *testing.T) {
+	appCtx := &app_context.AppContext{Lgr: zap.NewNop(), Store: unreachableStore{}, Notifier: notifier.NewRecordingNotifier()}
+	rec := httptest.NewRecorder()
+	GetHealthReady(appCtx, rec, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "10.0.0.12") || strings.Contains(rec.Body.String(), "brew") {
+		t.Errorf("response shouldn't include the db error, got %s", rec.Body)
+	}
+	var resp HealthResp
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Checks["db"].Detail != "unreachable" {
+		t.Errorf("expected the db to be reported unreachable, got %+v", resp.Checks["db"])
+	}
+}
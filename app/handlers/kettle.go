@@ -1,9 +1,14 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"strings"
 
 	"go.uber.org/zap"
 
@@ -14,10 +19,58 @@ import (
 	"github.com/ThePianoDentist/fancy-a-brew/utils"
 
 	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
 )
 
-func GetKettle(w http.ResponseWriter, r *http.Request) {
-	return
+type GetKettleResp struct {
+	Kettle storage.Kettle `json:"kettle"`
+	// empty if nobody is making
+	CurrentMakerNickname string                 `json:"currentMakerNickname"`
+	ActiveRound          *storage.Round         `json:"activeRound"`
+	MemberCount          int                    `json:"memberCount"`
+	Members              []storage.KettleMember `json:"members"`
+}
+
+func GetKettle(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kettleId, err := uuid.Parse(vars["kettleId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
+		return
+	}
+	kettle, err := appCtx.Store.GetKettle(r.Context(), kettleId)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such kettle", err)
+		return
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	resp := GetKettleResp{Kettle: kettle}
+
+	round, err := appCtx.Store.GetActiveRound(r.Context(), kettleId)
+	if err != nil && !errors.Is(err, storage.ErrNoActiveRound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	if err == nil {
+		resp.ActiveRound = &round
+		maker, err := appCtx.Store.GetUser(r.Context(), round.MakerId)
+		if err != nil {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+			return
+		}
+		resp.CurrentMakerNickname = maker.DefaultNickname
+	}
+
+	resp.Members, err = appCtx.Store.GetKettleMembers(r.Context(), kettleId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	resp.MemberCount = len(resp.Members)
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, resp)
 }
 
 type GetKettlesReq struct {
@@ -27,14 +80,39 @@ type GetKettlesReq struct {
 }
 
 type PostOfferBrewReq struct {
-	FirebaseToken string
+	// cancel whoever is currently making and take the round over
+	TakeOver bool
+}
+
+type PostOfferBrewResp struct {
+	storage.Round
+	// how many people are being told about the offer. the notifications themselves go out in the background
+	Queued int `json:"queued"`
+}
+
+type PostFinishedReq struct {
+	// where the drinks are waiting, e.g. "the kitchen counter". optional
+	CollectFrom string
+}
+
+type PostFinishedResp struct {
+	storage.Round
+	// how many drinkers are being told their drink's ready (or isn't coming)
+	Queued int `json:"queued"`
+}
+
+type PostBrewRespResp struct {
+	storage.DrinkRequest
+	// free text orders can't be checked against the menu properly, so they're let through with anything
+	// run out they seem to mention listed here
+	Unavailable []string `json:"unavailable"`
 }
 
 type PostBrewRespReq struct {
-	FirebaseToken  string
 	TheUsualTicked bool
-	Choice         string
-	Name           string
+	Order          *storage.DrinkOrder
+	// free text, from old app versions. ignored if Order is sent
+	Choice string
 }
 
 func GetHotSteamyKettlesInYourArea(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
@@ -44,7 +122,7 @@ func GetHotSteamyKettlesInYourArea(appCtx *app_context.AppContext, w http.Respon
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
 		return
 	}
-	kettles, err := storage.GetKettlesWithinRadius(appCtx.DB, d.Long, d.Lat, d.MetreRadius)
+	kettles, err := appCtx.Store.GetKettlesWithinRadius(r.Context(), d.Long, d.Lat, d.MetreRadius)
 	if err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, 500, "unexpected goof getting kettles", err)
 		return
@@ -63,12 +141,29 @@ func PostKettle(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.R
 	// I think reading body is weird/dumb. and defering before reading body leads to panic in some scenarios.
 	// (add stack overflow link here if find/know)
 	defer r.Body.Close()
-	kettleId, err := k.UpsertKettle(appCtx.DB)
+	if k.NotifyMode != "" && !k.NotifyMode.IsValid() {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("notifyMode must be one of %s, %s, %s", storage.NotifyNearby, storage.NotifyMembers, storage.NotifyNearbyMembers), nil)
+		return
+	}
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+	kettleId, err := appCtx.Store.UpsertKettle(r.Context(), &k, userId)
+	if errors.Is(err, storage.ErrNotKettleMember) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "That kettle already exists. Only its members can change it", err)
+		return
+	}
 	if err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
 		return
 	}
-	utils.SuccessResp(appCtx.Lgr, w, 201, map[string]string{"kettleId": kettleId.String(), "name": k.Name})
+	// whoever sets up the kettle is obviously going to want to drink from it
+	if err := appCtx.Store.AddKettleMember(r.Context(), kettleId, userId); err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, 201, map[string]string{"kettleId": kettleId.String(), "name": k.Name, "notifyMode": string(k.NotifyMode)})
 }
 
 func PostOfferBrew(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
@@ -79,45 +174,90 @@ func PostOfferBrew(appCtx *app_context.AppContext, w http.ResponseWriter, r *htt
 		return
 	}
 
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+
 	decoder := json.NewDecoder(r.Body)
 	var d PostOfferBrewReq
-	if err := decoder.Decode(&d); err != nil {
+	// everything in the body is optional, so an empty one is fine
+	if err := decoder.Decode(&d); err != nil && err != io.EOF {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
 		return
 	}
 
-	userId, err := storage.GetUserIdFromToken(appCtx.DB, d.FirebaseToken)
+	kettle, err := appCtx.Store.GetKettle(r.Context(), kettleId)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such kettle", err)
+		return
+	}
 	if err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
 		return
 	}
-
-	kettle, err := storage.GetKettle(appCtx.DB, kettleId)
+	maker, err := appCtx.Store.GetUser(r.Context(), userId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	menu, err := appCtx.Store.GetKettleMenu(r.Context(), kettleId)
 	if err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
 		return
 	}
-	usersInRadius, err := storage.GetUsersWithinRadius(appCtx.DB, kettle.Long, kettle.Lat, 100)
-	data := map[string]string{
-		"kettleId":   kettleId.String(),
-		"kettleName": kettle.Name,
-		"type":       "offer",
-		// TODO get username of maker (send firebase token and then do a user-lookup)
+	recipients, err := appCtx.Store.GetOfferRecipients(r.Context(), kettle, appCtx.Cfg.NotificationRadiusMetres)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	// a round can only be taken over once it's been left alone for a while, members or not
+	staleAfter := appCtx.Cfg.Rounds.TakeOverAfter.Duration()
+	round, cancelled, err := appCtx.Store.ClaimKettle(r.Context(), kettle.KettleId, userId, d.TakeOver, staleAfter)
+	var busyErr *storage.KettleBusyError
+	if errors.As(err, &busyErr) {
+		msg := fmt.Sprintf("%s is already making a round on this kettle", busyErr.MakerNickname)
+		if d.TakeOver {
+			msg += fmt.Sprintf(". It can't be taken over until it's been left for %s", storage.Plural(int(math.Ceil(staleAfter.Minutes())), "minute"))
+		}
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, msg, err)
+		return
 	}
-	if err := storage.SetCurrentMaker(appCtx.DB, kettle.KettleId, userId); err != nil {
+	if errors.Is(err, storage.ErrRoundInProgress) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Someone is already making a round on this kettle", err)
+		return
+	}
+	if err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
 		return
 	}
-	for _, user := range usersInRadius {
-		err := appCtx.FcmController.SendFCM(user.FirebaseToken, data)
-		if err != nil {
-			appCtx.Lgr.Error("error publishing fcm message", zap.Error(err))
-			// Keep going as one failure shouldnt kill everything.
-			// however might need to keep track of this when it comes to checking responses.
-			// I guess as we don't wait for everyone to
+	payload := notifier.OfferPayload{
+		KettleId:      kettleId,
+		KettleName:    kettle.Name,
+		RoundId:       round.RoundId,
+		MakerId:       userId,
+		MakerNickname: maker.DefaultNickname,
+		Deadline:      round.OfferedAt.Add(appCtx.Cfg.Rounds.Timeout.Duration()),
+		Menu:          menu,
+	}
+	others := make([]storage.User, 0, len(recipients))
+	for _, user := range recipients {
+		// no need to offer the maker a drink
+		if user.UserId != userId {
+			others = append(others, user)
 		}
 	}
-	utils.SuccessResp(appCtx.Lgr, w, 200, struct{}{})
+	queued, err := appCtx.Outbox.Enqueue(r.Context(), others, payload)
+	if err != nil {
+		// the round's claimed either way. failing here would just have the maker retry into their own round
+		appCtx.Lgr.Error("error queueing offer notifications", zap.String("roundId", round.RoundId.String()), zap.Error(err))
+	}
+	if cancelled != nil {
+		if err := notifyRoundTakenOver(appCtx, r.Context(), kettle, *cancelled, round, maker); err != nil {
+			appCtx.Lgr.Error("error queueing taken over notifications", zap.String("roundId", cancelled.RoundId.String()), zap.Error(err))
+		}
+	}
+	utils.SuccessResp(appCtx.Lgr, w, 200, PostOfferBrewResp{Round: round, Queued: queued})
 }
 
 func PostBrewResponse(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
@@ -135,24 +275,91 @@ func PostBrewResponse(appCtx *app_context.AppContext, w http.ResponseWriter, r *
 		return
 	}
 
-	kettle, err := storage.GetKettle(appCtx.DB, kettleId)
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+	user, err := appCtx.Store.GetUser(r.Context(), userId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	choice, order := d.Choice, d.Order
+	if d.TheUsualTicked {
+		choice, order = user.TheUsual, user.TheUsualOrder
+	} else if order != nil {
+		if err := order.Validate(); err != nil {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		choice = order.String()
+	}
+	if choice == "" {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "What do you want to drink? Choice can't be empty", nil)
+		return
+	}
+
+	round, err := appCtx.Store.GetActiveRound(r.Context(), kettleId)
+	if errors.Is(err, storage.ErrNoActiveRound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Too late! Nobody is making a round right now", err)
+		return
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	menu, err := appCtx.Store.GetKettleMenu(r.Context(), kettleId)
 	if err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
 		return
 	}
-	if (kettle.CurrentMaker == uuid.UUID{}) {
-		// TODO send message back saying too-late baby
+	unavailable := make([]string, 0)
+	if order != nil {
+		if missing := menu.Unavailable(*order); len(missing) > 0 {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, fmt.Sprintf("Sorry, no %s here right now. Fancy something else?", strings.Join(missing, " or ")), nil)
+			return
+		}
+	} else {
+		unavailable = menu.MentionedOutOfStock(choice)
+	}
+	dr := storage.DrinkRequest{RoundId: round.RoundId, UserId: userId, Nickname: user.DefaultNickname, Choice: choice, Order: order, TheUsualTicked: d.TheUsualTicked}
+	// the round's state is checked as the request goes in, it could have moved on since we looked it up
+	_, err = appCtx.Store.UpsertDrinkRequest(r.Context(), &dr)
+	if errors.Is(err, storage.ErrRoundClosed) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Too late! That round has stopped taking orders", err)
 		return
 	}
-	maker, err := storage.GetUser(appCtx.DB, kettle.CurrentMaker)
 	if err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
 		return
 	}
-	if err := appCtx.FcmController.SendFCM(maker.FirebaseToken, map[string]string{"choice": d.Choice, "name": d.Name, "type": "drinkrequest"}); err != nil {
-		appCtx.Lgr.Error("error publishing fcm message", zap.Error(err))
+	if round.State == storage.RoundOffered {
+		// first response in. if someone else's response beat us to it that's fine, round is collecting either way.
+		if err := appCtx.Store.TransitionRound(r.Context(), &round, storage.RoundCollecting); err != nil && !errors.Is(err, storage.ErrIllegalTransition) {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+			return
+		}
+	}
+	maker, err := appCtx.Store.GetUser(r.Context(), round.MakerId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	// the request is stored now, so if this push goes missing the maker can still pull it from rounds/current/
+	payload := notifier.DrinkRequestPayload{
+		KettleId:          kettleId,
+		RoundId:           round.RoundId,
+		RequestId:         dr.RequestId,
+		RequesterId:       userId,
+		RequesterNickname: user.DefaultNickname,
+		Choice:            choice,
+		Order:             order,
+		Unavailable:       unavailable,
 	}
-	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, struct{}{})
+	if _, err := appCtx.Outbox.Enqueue(r.Context(), []storage.User{maker}, payload); err != nil {
+		appCtx.Lgr.Error("error queueing notification", zap.Error(err))
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, PostBrewRespResp{DrinkRequest: dr, Unavailable: unavailable})
 }
 
 func PostFinished(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
@@ -162,9 +369,127 @@ func PostFinished(appCtx *app_context.AppContext, w http.ResponseWriter, r *http
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
 		return
 	}
-	if err := storage.SetCurrentMaker(appCtx.DB, kettleId, uuid.UUID{}); err != nil {
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	var d PostFinishedReq
+	// everything in the body is optional, so an empty one is fine
+	if err := decoder.Decode(&d); err != nil && err != io.EOF {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	round, err := appCtx.Store.GetActiveRound(r.Context(), kettleId)
+	if errors.Is(err, storage.ErrNoActiveRound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Nobody is making a round right now", err)
+		return
+	}
+	if err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
 		return
 	}
-	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, struct{}{})
+	if round.MakerId != userId {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "Only the maker can finish their round", nil)
+		return
+	}
+	// if nobody wanted a drink there was nothing to deliver
+	to := storage.RoundDelivered
+	if round.State == storage.RoundOffered {
+		to = storage.RoundCancelled
+	}
+	if err := appCtx.Store.TransitionRound(r.Context(), &round, to); err != nil {
+		roundTransitionErrorResp(appCtx, w, err)
+		return
+	}
+	queued := 0
+	if to == storage.RoundDelivered {
+		// the round's done either way. drinkers can still see how it went from their own app if this fails
+		queued, err = notifyRoundFinished(appCtx, r.Context(), round, strings.TrimSpace(d.CollectFrom))
+		if err != nil {
+			appCtx.Lgr.Error("error queueing round finished notifications", zap.String("roundId", round.RoundId.String()), zap.Error(err))
+		}
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, PostFinishedResp{Round: round, Queued: queued})
+}
+
+// Tells the old maker and everyone who'd ordered in the cancelled round that newMaker's taken over,
+// so their orders are gone. newMaker already knows.
+func notifyRoundTakenOver(appCtx *app_context.AppContext, ctx context.Context, kettle storage.Kettle, cancelled, round storage.Round, newMaker storage.User) error {
+	requests, err := appCtx.Store.GetRoundDrinkRequests(ctx, cancelled.RoundId)
+	if err != nil {
+		return err
+	}
+	oldMaker, err := appCtx.Store.GetUser(ctx, cancelled.MakerId)
+	if err != nil {
+		return err
+	}
+	others := make([]storage.User, 0, len(requests)+1)
+	if cancelled.MakerId != newMaker.UserId {
+		others = append(others, oldMaker)
+	}
+	for _, dr := range requests {
+		if dr.UserId != cancelled.MakerId && dr.UserId != newMaker.UserId {
+			others = append(others, storage.User{UserId: dr.UserId})
+		}
+	}
+	payload := notifier.RoundTakenOverPayload{
+		KettleId:         kettle.KettleId,
+		KettleName:       kettle.Name,
+		RoundId:          cancelled.RoundId,
+		MakerId:          cancelled.MakerId,
+		MakerNickname:    oldMaker.DefaultNickname,
+		NewRoundId:       round.RoundId,
+		NewMakerId:       newMaker.UserId,
+		NewMakerNickname: newMaker.DefaultNickname,
+	}
+	_, err = appCtx.Outbox.Enqueue(ctx, others, payload)
+	return err
+}
+
+// Tells everyone who ordered in the round (and nobody else) that it's finished. If the maker ticked off any drinks,
+// the ones they didn't are reported as not made. Returns how many drinkers are being told.
+func notifyRoundFinished(appCtx *app_context.AppContext, ctx context.Context, round storage.Round, collectFrom string) (int, error) {
+	requests, err := appCtx.Store.GetRoundDrinkRequests(ctx, round.RoundId)
+	if err != nil || len(requests) == 0 {
+		return 0, err
+	}
+	kettle, err := appCtx.Store.GetKettle(ctx, round.KettleId)
+	if err != nil {
+		return 0, err
+	}
+	maker, err := appCtx.Store.GetUser(ctx, round.MakerId)
+	if err != nil {
+		return 0, err
+	}
+	ticked := false
+	for _, dr := range requests {
+		if dr.DoneAt != nil {
+			ticked = true
+			break
+		}
+	}
+	queued := 0
+	for _, dr := range requests {
+		// they know, they made it
+		if dr.UserId == round.MakerId {
+			continue
+		}
+		payload := notifier.RoundFinishedPayload{
+			KettleId:      round.KettleId,
+			KettleName:    kettle.Name,
+			RoundId:       round.RoundId,
+			MakerId:       round.MakerId,
+			MakerNickname: maker.DefaultNickname,
+			Choice:        dr.Choice,
+			Made:          !ticked || dr.DoneAt != nil,
+			CollectFrom:   collectFrom,
+		}
+		n, err := appCtx.Outbox.Enqueue(ctx, []storage.User{{UserId: dr.UserId}}, payload)
+		if err != nil {
+			return queued, err
+		}
+		queued += n
+	}
+	return queued, nil
 }
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+// The caller joins the kettle, so they hear about offers even when the kettle is members-only.
+// Only from nearby though (same radius as offers go out to), otherwise an existing member has to add them.
+func PostKettleMember(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kettleId, err := uuid.Parse(vars["kettleId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
+		return
+	}
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+	if _, err := appCtx.Store.GetKettle(r.Context(), kettleId); errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such kettle", err)
+		return
+	} else if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	isMember, err := appCtx.Store.IsKettleMember(r.Context(), kettleId, userId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	if !isMember {
+		isNear, err := appCtx.Store.IsUserNearKettle(r.Context(), kettleId, userId, appCtx.Cfg.NotificationRadiusMetres)
+		if err != nil {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+			return
+		}
+		if !isNear {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "You need to be near the kettle to join it, or ask one of its members to add you", nil)
+			return
+		}
+		if err := appCtx.Store.AddKettleMember(r.Context(), kettleId, userId); err != nil {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+			return
+		}
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusCreated, map[string]string{"kettleId": kettleId.String(), "userId": userId.String()})
+}
+
+// A member adds someone else to the kettle, e.g. a colleague who's not in the office yet.
+func PostKettleMemberInvite(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	kettleId, _, ok := sessionUserIsKettleMember(appCtx, w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	inviteeId, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid userId. Got: %s", vars["userId"]), err)
+		return
+	}
+	if err := appCtx.Store.AddKettleMember(r.Context(), kettleId, inviteeId); errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such user", err)
+		return
+	} else if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusCreated, map[string]string{"kettleId": kettleId.String(), "userId": inviteeId.String()})
+}
+
+// The caller leaves the kettle.
+func DeleteKettleMember(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kettleId, err := uuid.Parse(vars["kettleId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
+		return
+	}
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+	removed, err := appCtx.Store.RemoveKettleMember(r.Context(), kettleId, userId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	if !removed {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "You're not a member of this kettle", nil)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, struct{}{})
+}
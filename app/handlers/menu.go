@@ -0,0 +1,135 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+type PutKettleMenuReq struct {
+	Items []storage.MenuItem
+}
+
+type PostMenuStockReq struct {
+	Kind    storage.MenuKind
+	Item    string
+	InStock bool
+}
+
+// What the kettle can make and what's run out. Empty if the kettle hasn't said, in which case anything goes.
+func GetKettleMenu(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kettleId, err := uuid.Parse(vars["kettleId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
+		return
+	}
+	if _, err := appCtx.Store.GetKettle(r.Context(), kettleId); errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such kettle", err)
+		return
+	} else if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	menu, err := appCtx.Store.GetKettleMenu(r.Context(), kettleId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, menu)
+}
+
+// Replaces the whole menu. Any member can. An empty list clears it, so anything goes again.
+func PutKettleMenu(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	kettleId, userId, ok := sessionUserIsKettleMember(appCtx, w, r)
+	if !ok {
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	var d PutKettleMenuReq
+	if err := decoder.Decode(&d); err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	menu := make(storage.Menu, 0, len(d.Items))
+	for _, item := range d.Items {
+		if err := item.Validate(); err != nil {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		for _, seen := range menu {
+			if seen.Kind == item.Kind && seen.Item == item.Item {
+				utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("%s is on the menu twice", item.Label()), nil)
+				return
+			}
+		}
+		menu = append(menu, item)
+	}
+	if err := appCtx.Store.SetKettleMenu(r.Context(), kettleId, userId, menu); err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	menu, err := appCtx.Store.GetKettleMenu(r.Context(), kettleId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, menu)
+}
+
+// "We're out of milk". Any member can mark something on the menu as run out, or back in stock.
+func PostMenuStock(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	kettleId, userId, ok := sessionUserIsKettleMember(appCtx, w, r)
+	if !ok {
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	var d PostMenuStockReq
+	if err := decoder.Decode(&d); err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	item, err := appCtx.Store.SetMenuItemStock(r.Context(), kettleId, userId, d.Kind, d.Item, d.InStock)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "That's not on the menu", err)
+		return
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, item)
+}
+
+// For /kettles/{kettleId}/... endpoints only members can use. Writes a 400/403 and returns false if the caller
+// isn't a member of the path's kettle.
+func sessionUserIsKettleMember(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) (uuid.UUID, uuid.UUID, bool) {
+	vars := mux.Vars(r)
+	kettleId, err := uuid.Parse(vars["kettleId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
+		return uuid.UUID{}, uuid.UUID{}, false
+	}
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return uuid.UUID{}, uuid.UUID{}, false
+	}
+	isMember, err := appCtx.Store.IsKettleMember(r.Context(), kettleId, userId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return uuid.UUID{}, uuid.UUID{}, false
+	}
+	if !isMember {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "Only members of the kettle can do that", nil)
+		return uuid.UUID{}, uuid.UUID{}, false
+	}
+	return kettleId, userId, true
+}
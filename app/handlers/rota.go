@@ -0,0 +1,116 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+type GetKettleRotaResp struct {
+	// whose turn it is first
+	Rota []storage.RotaEntry `json:"rota"`
+	// who should make the next round. nil if the kettle has no members
+	Suggested *storage.RotaEntry `json:"suggested"`
+}
+
+type PostRoundRequestResp struct {
+	// whose turn it is. nil if there's nobody else in the kettle
+	Suggested *storage.RotaEntry `json:"suggested"`
+	// whether they've been sent a notification. not if nudges are turned off or someone asked too recently
+	Nudged bool `json:"nudged"`
+}
+
+// Cups made vs cups drunk for every member, and whose turn it is. Members only.
+func GetKettleRota(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	kettleId, _, ok := sessionUserIsKettleMember(appCtx, w, r)
+	if !ok {
+		return
+	}
+	rota, err := appCtx.Store.GetKettleRota(r.Context(), kettleId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	resp := GetKettleRotaResp{Rota: rota}
+	if len(rota) > 0 {
+		resp.Suggested = &rota[0]
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, resp)
+}
+
+// "Anyone putting the kettle on?" Asks for a round when nobody's making. Whoever's turn it is gets a nudge,
+// unless the kettle's already had one within rota.nudge_cooldown.
+func PostRoundRequest(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	kettleId, userId, ok := sessionUserIsKettleMember(appCtx, w, r)
+	if !ok {
+		return
+	}
+	_, err := appCtx.Store.GetActiveRound(r.Context(), kettleId)
+	if err == nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Someone's already making a round, get your order in!", nil)
+		return
+	}
+	if !errors.Is(err, storage.ErrNoActiveRound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	rota, err := appCtx.Store.GetKettleRota(r.Context(), kettleId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	var resp PostRoundRequestResp
+	for i := range rota {
+		// asking for a drink then being told to make it yourself would be a bit rude
+		if rota[i].UserId != userId {
+			resp.Suggested = &rota[i]
+			break
+		}
+	}
+	if resp.Suggested == nil || !appCtx.Cfg.Rota.Nudge {
+		utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, resp)
+		return
+	}
+	kettle, err := appCtx.Store.GetKettle(r.Context(), kettleId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	requester, err := appCtx.Store.GetUser(r.Context(), userId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	payload := notifier.NudgePayload{
+		KettleId:          kettleId,
+		KettleName:        kettle.Name,
+		RequesterId:       userId,
+		RequesterNickname: requester.DefaultNickname,
+	}
+	if resp.Suggested.Balance < 0 {
+		payload.CupsOwed = -resp.Suggested.Balance
+	}
+	// marked as late as possible, so failing to load anything above doesn't use up the cooldown without a nudge
+	nudge, err := appCtx.Store.MarkKettleNudged(r.Context(), kettleId, time.Now().UTC().Add(-appCtx.Cfg.Rota.NudgeCooldown.Duration()))
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	if !nudge {
+		utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, resp)
+		return
+	}
+	queued, err := appCtx.Outbox.Enqueue(r.Context(), []storage.User{{UserId: resp.Suggested.UserId}}, payload)
+	if err != nil {
+		appCtx.Lgr.Error("error queueing nudge", zap.String("kettleId", kettleId.String()), zap.Error(err))
+	}
+	resp.Nudged = queued > 0
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, resp)
+}
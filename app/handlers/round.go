@@ -0,0 +1,168 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+// Maker has stopped taking orders and is making the drinks.
+func PostStartBrewing(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kettleId, err := uuid.Parse(vars["kettleId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
+		return
+	}
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+	round, err := appCtx.Store.GetActiveRound(r.Context(), kettleId)
+	if errors.Is(err, storage.ErrNoActiveRound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Nobody is making a round right now", err)
+		return
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	if round.MakerId != userId {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "Only the maker can start brewing their round", nil)
+		return
+	}
+	if err := appCtx.Store.TransitionRound(r.Context(), &round, storage.RoundBrewing); err != nil {
+		roundTransitionErrorResp(appCtx, w, err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, round)
+}
+
+type GetCurrentRoundResp struct {
+	Round    storage.Round          `json:"round"`
+	Requests []storage.DrinkRequest `json:"requests"`
+}
+
+// Lets the maker (or anyone re-opening the app from a notification) pull the in-progress round and every order so far.
+func GetCurrentRound(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	_, round, requests, ok := sessionUserActiveRound(appCtx, w, r)
+	if !ok {
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, GetCurrentRoundResp{Round: round, Requests: requests})
+}
+
+// The kettle's active round and its requests, as long as the session user is allowed to see them.
+// That's the kettle's members, plus the maker and whoever's ordered, as nearby kettles offer to non-members.
+// Writes the error response and returns false otherwise.
+func sessionUserActiveRound(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) (uuid.UUID, storage.Round, []storage.DrinkRequest, bool) {
+	vars := mux.Vars(r)
+	kettleId, err := uuid.Parse(vars["kettleId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
+		return uuid.UUID{}, storage.Round{}, nil, false
+	}
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return uuid.UUID{}, storage.Round{}, nil, false
+	}
+	round, err := appCtx.Store.GetActiveRound(r.Context(), kettleId)
+	if errors.Is(err, storage.ErrNoActiveRound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "Nobody is making a round right now", err)
+		return uuid.UUID{}, storage.Round{}, nil, false
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return uuid.UUID{}, storage.Round{}, nil, false
+	}
+	requests, err := appCtx.Store.GetRoundDrinkRequests(r.Context(), round.RoundId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return uuid.UUID{}, storage.Round{}, nil, false
+	}
+	if round.MakerId == userId {
+		return kettleId, round, requests, true
+	}
+	for _, dr := range requests {
+		if dr.UserId == userId {
+			return kettleId, round, requests, true
+		}
+	}
+	isMember, err := appCtx.Store.IsKettleMember(r.Context(), kettleId, userId)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return uuid.UUID{}, storage.Round{}, nil, false
+	}
+	if !isMember {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "Only members of the kettle, or people in the round, can see it", nil)
+		return uuid.UUID{}, storage.Round{}, nil, false
+	}
+	return kettleId, round, requests, true
+}
+
+// Maker ticks a drink off as made. Once any are ticked off, whoever's left unticked when the round's finished is told
+// their drink didn't happen.
+func PostDrinkDone(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	setDrinkDone(appCtx, w, r, true)
+}
+
+// Unticks a drink the maker ticked off by mistake.
+func DeleteDrinkDone(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	setDrinkDone(appCtx, w, r, false)
+}
+
+func setDrinkDone(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request, done bool) {
+	vars := mux.Vars(r)
+	kettleId, err := uuid.Parse(vars["kettleId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid kettleId. Got: %s", vars["kettleId"]), err)
+		return
+	}
+	requestId, err := uuid.Parse(vars["requestId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid requestId. Got: %s", vars["requestId"]), err)
+		return
+	}
+	userId, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+	round, err := appCtx.Store.GetActiveRound(r.Context(), kettleId)
+	if errors.Is(err, storage.ErrNoActiveRound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Nobody is making a round right now", err)
+		return
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	if round.MakerId != userId {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "Only the maker can tick drinks off", nil)
+		return
+	}
+	err = appCtx.Store.SetDrinkRequestDone(r.Context(), round.RoundId, requestId, done)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "Nobody ordered that this round", err)
+		return
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, struct{}{})
+}
+
+func roundTransitionErrorResp(appCtx *app_context.AppContext, w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrIllegalTransition) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Round can't do that from its current state", err)
+		return
+	}
+	utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+}
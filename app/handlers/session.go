@@ -0,0 +1,82 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+type PostSignInRequestReq struct {
+	FirebaseToken string
+}
+
+type PostSessionReq struct {
+	// from the signin notification
+	Code string
+}
+
+// For a registered device whose session has expired (or was signed with an old secret). Pushes a sign in code
+// to the owner's devices, which the app swaps for a session with POST /sessions/.
+func PostSignInRequest(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var d PostSignInRequestReq
+	if err := decoder.Decode(&d); err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	userId, err := appCtx.Store.GetUserIdFromToken(r.Context(), d.FirebaseToken)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "That device isn't registered. Sign up with POST /users/", err)
+		return
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	code, expiresAt := appCtx.Sessions.IssueSignIn(userId)
+	queued, err := appCtx.Outbox.Enqueue(r.Context(), []storage.User{{UserId: userId}}, notifier.SignInPayload{Code: code, ExpiresAt: expiresAt})
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	if queued == 0 {
+		// the token's registered but marked dead, so there's nowhere to send the code
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "Can't reach that device. Register it again with POST /users/", nil)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusAccepted, map[string]string{"expiresAt": expiresAt.Format(time.RFC3339)})
+}
+
+// Swaps a sign in code for a new session.
+func PostSession(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var d PostSessionReq
+	if err := decoder.Decode(&d); err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	userId, err := appCtx.Sessions.VerifySignIn(d.Code)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusUnauthorized, "That code is wrong or has expired. Ask for another one", err)
+		return
+	}
+	if _, err := appCtx.Store.GetUser(r.Context(), userId); errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusUnauthorized, "That code is for a user that doesn't exist anymore", err)
+		return
+	} else if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	token, expiresAt := appCtx.Sessions.Issue(userId)
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusCreated, map[string]string{
+		"userId":       userId.String(),
+		"sessionToken": token,
+		"expiresAt":    expiresAt.Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,135 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+)
+
+// ?period= values and how far back they go. all (the default) has no limit
+var statsPeriods = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"year":  365 * 24 * time.Hour,
+	"all":   0,
+}
+
+type StatsPeriod struct {
+	Period string `json:"period"`
+	// nil for all time
+	Since *time.Time `json:"since"`
+	// what the hours are in
+	TimeZone string `json:"timeZone"`
+}
+
+type GetUserStatsResp struct {
+	StatsPeriod
+	storage.UserStats
+}
+
+type GetKettleStatsResp struct {
+	StatsPeriod
+	storage.KettleStats
+}
+
+// ?period=day|week|month|year|all (default all) and ?tz=Europe/London (default UTC) for which hour of the day
+// things happened in. Writes a 400 and returns false if either is no good.
+func statsPeriod(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) (StatsPeriod, *time.Location, bool) {
+	p := StatsPeriod{Period: r.URL.Query().Get("period"), TimeZone: r.URL.Query().Get("tz")}
+	if p.Period == "" {
+		p.Period = "all"
+	}
+	lookBack, ok := statsPeriods[p.Period]
+	if !ok {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "period must be one of day, week, month, year, all", nil)
+		return p, nil, false
+	}
+	if lookBack > 0 {
+		since := time.Now().UTC().Add(-lookBack)
+		p.Since = &since
+	}
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("unknown tz %s. expected something like Europe/London", p.TimeZone), err)
+		return p, nil, false
+	}
+	p.TimeZone = loc.String()
+	return p, loc, true
+}
+
+func (p StatsPeriod) since() time.Time {
+	if p.Since == nil {
+		return time.Time{}
+	}
+	return *p.Since
+}
+
+// How much someone's drunk and made, what they like and when. Only for yourself.
+func GetUserStats(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid userId. Got: %s", vars["userId"]), err)
+		return
+	}
+	sessionUser, ok := sessionUserId(appCtx, w, r)
+	if !ok {
+		return
+	}
+	if sessionUser != userId {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusForbidden, "You can only see your own stats", nil)
+		return
+	}
+	period, loc, ok := statsPeriod(appCtx, w, r)
+	if !ok {
+		return
+	}
+	if _, err := appCtx.Store.GetUser(r.Context(), userId); errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such user", err)
+		return
+	} else if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	stats, err := appCtx.Store.GetUserStats(r.Context(), userId, period.since(), loc)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, GetUserStatsResp{StatsPeriod: period, UserStats: stats})
+}
+
+// Rounds and cups for the whole kettle, its favourite drinks, busiest hours and who makes/drinks the most.
+// Members only.
+func GetKettleStats(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	kettleId, _, ok := sessionUserIsKettleMember(appCtx, w, r)
+	if !ok {
+		return
+	}
+	period, loc, ok := statsPeriod(appCtx, w, r)
+	if !ok {
+		return
+	}
+	if _, err := appCtx.Store.GetKettle(r.Context(), kettleId); errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such kettle", err)
+		return
+	} else if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	stats, err := appCtx.Store.GetKettleStats(r.Context(), kettleId, period.since(), loc)
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, GetKettleStatsResp{StatsPeriod: period, KettleStats: stats})
+}
@@ -2,10 +2,17 @@ package app
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 
+	"github.com/ThePianoDentist/fancy-a-brew/app/middleware"
+
 	"github.com/ThePianoDentist/fancy-a-brew/utils"
 
 	"github.com/ThePianoDentist/fancy-a-brew/app_context"
@@ -13,25 +20,125 @@ import (
 	"github.com/ThePianoDentist/fancy-a-brew/storage"
 )
 
-func GetUser(w http.ResponseWriter, r *http.Request) {
-	return
+// What other people get to see about a user. Deliberately not storage.User so their location never leaks.
+type UserProfile struct {
+	UserId   uuid.UUID `json:"userId"`
+	Nickname string    `json:"nickname"`
+	TheUsual string    `json:"theUsual"`
+	// nil if their usual is free text
+	TheUsualOrder *storage.DrinkOrder `json:"theUsualOrder"`
+}
+
+func GetUser(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userId, err := uuid.Parse(vars["userId"])
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, fmt.Sprintf("expected uuid userId. Got: %s", vars["userId"]), err)
+		return
+	}
+	user, err := appCtx.Store.GetUser(r.Context(), userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusNotFound, "No such user", err)
+		return
+	}
+	if err != nil {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+		return
+	}
+	utils.SuccessResp(appCtx.Lgr, w, http.StatusOK, UserProfile{
+		UserId: user.UserId, Nickname: user.DefaultNickname, TheUsual: user.TheUsual, TheUsualOrder: user.TheUsualOrder,
+	})
+}
+
+type PostUserReq struct {
+	// required for new users, optional when updating yourself
+	FirebaseToken   string
+	DefaultNickname string
+	// free text, from old app versions. ignored if TheUsualOrder is sent
+	TheUsual      string
+	TheUsualOrder *storage.DrinkOrder
+	LastKnownLong float64
+	LastKnownLat  float64
+	// optional, shows up in the device list
+	DeviceName string
 }
 
+// Updates you if you send your session, otherwise signs up a new user. A refreshed token sent with a session
+// stays the same user. Without one, a token that's already registered is a 409 rather than a way into that account.
+// The firebase token is (re-)registered as one of your devices.
 func PostUser(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
-	var u storage.User
-	if err := decoder.Decode(&u); err != nil {
+	var d PostUserReq
+	if err := decoder.Decode(&d); err != nil {
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "Invalid request payload", err)
 		return
 	}
 	// I think reading body is weird/dumb. and defering before reading body leads to panic in some scenarios.
 	// (add stack overflow link here if find/know)
 	defer r.Body.Close()
-	userId, err := u.UpsertUser(appCtx.DB)
+	u := storage.User{DefaultNickname: d.DefaultNickname, TheUsual: d.TheUsual, LastKnownLong: d.LastKnownLong, LastKnownLat: d.LastKnownLat}
+	if d.TheUsualOrder != nil {
+		if err := d.TheUsualOrder.Validate(); err != nil {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+		u.TheUsual, u.TheUsualOrder = d.TheUsualOrder.String(), d.TheUsualOrder
+	}
+	// an expired/garbled session is just treated as not having one
+	if sessionUserId, err := appCtx.Sessions.VerifyRequest(r); err == nil {
+		u.UserId = sessionUserId
+	} else if d.FirebaseToken != "" {
+		// knowing a token isn't proof of being its owner, so it never gets you someone else's session.
+		// checked before making the new user so we don't leave one lying around without a device
+		_, err := appCtx.Store.GetUserIdFromToken(r.Context(), d.FirebaseToken)
+		if err == nil {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "That device is already registered. Send your session token to update yourself, or sign back in with POST /sessions/request/", storage.ErrDeviceTaken)
+			return
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+			return
+		}
+	}
+	if u.UserId == uuid.Nil && d.FirebaseToken == "" {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusBadRequest, "FirebaseToken is required to sign up", nil)
+		return
+	}
+	userId, err := appCtx.Store.UpsertUser(r.Context(), &u)
+	if errors.Is(err, storage.ErrNotFound) {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusUnauthorized, "Your session is for a user that doesn't exist anymore", err)
+		return
+	}
 	if err != nil {
 		appCtx.Lgr.Error("error inserting user:", zap.Error(err))
 		utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
 		return
 	}
-	utils.SuccessResp(appCtx.Lgr, w, 201, map[string]string{"userId": userId.String()})
+	resp := map[string]string{"userId": userId.String()}
+	if d.FirebaseToken != "" {
+		device := storage.Device{UserId: userId, FirebaseToken: d.FirebaseToken, Name: d.DeviceName}
+		if err := appCtx.Store.RegisterDevice(r.Context(), &device); errors.Is(err, storage.ErrDeviceTaken) {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusConflict, "That device is registered to someone else. They need to remove it first", err)
+			return
+		} else if err != nil {
+			utils.ErrorResp(appCtx.Lgr, w, http.StatusInternalServerError, "Fudge! Something went wrong. Bug reports to jkthepianodentist@gmail.com", err)
+			return
+		}
+		resp["deviceId"] = device.DeviceId.String()
+	}
+	// the app sends this back as `Authorization: Bearer <sessionToken>` on everything that needs to know who it is
+	token, expiresAt := appCtx.Sessions.Issue(userId)
+	resp["sessionToken"] = token
+	resp["expiresAt"] = expiresAt.Format(time.RFC3339)
+	utils.SuccessResp(appCtx.Lgr, w, 201, resp)
+}
+
+// The authenticated caller. Only for handlers registered behind middleware.RequireSession,
+// writes a 401 and returns false if somehow there's no user in the context.
+func sessionUserId(appCtx *app_context.AppContext, w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	userId, ok := middleware.UserIdFromContext(r.Context())
+	if !ok {
+		utils.ErrorResp(appCtx.Lgr, w, http.StatusUnauthorized, "Who are you? Missing session token", middleware.ErrInvalidSession)
+	}
+	return userId, ok
 }
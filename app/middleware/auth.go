@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ThePianoDentist/fancy-a-brew/utils"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const DefaultSessionTTL = 30 * 24 * time.Hour
+
+// how long the sign in code pushed to a device is good for
+const SignInTTL = 10 * time.Minute
+
+// sign in codes have this in front of the user id, so they're a different length to session tokens and
+// one can never be passed off as the other
+var signInPrefix = []byte("signin")
+
+var ErrInvalidSession = errors.New("invalid or expired session token")
+
+type ctxKey int
+
+const userIdCtxKey ctxKey = iota
+
+// Issues and checks session tokens handed out by POST /users/.
+// A token is base64(userId + expiry) "." base64(hmac-sha256 of that), so no DB lookup is needed to verify one.
+type SessionSigner struct {
+	secret []byte
+	TTL    time.Duration
+}
+
+func NewSessionSigner(secret []byte) *SessionSigner {
+	return &SessionSigner{secret: secret, TTL: DefaultSessionTTL}
+}
+
+func (s *SessionSigner) Issue(userId uuid.UUID) (string, time.Time) {
+	return s.issue(nil, userId, s.TTL)
+}
+
+func (s *SessionSigner) Verify(token string) (uuid.UUID, error) {
+	return s.verify(nil, token)
+}
+
+// A short lived code that can be swapped for a session with VerifySignIn. It's pushed to the user's devices,
+// so getting one back proves the caller has one of them, e.g. when their session's expired.
+func (s *SessionSigner) IssueSignIn(userId uuid.UUID) (string, time.Time) {
+	return s.issue(signInPrefix, userId, SignInTTL)
+}
+
+func (s *SessionSigner) VerifySignIn(code string) (uuid.UUID, error) {
+	return s.verify(signInPrefix, code)
+}
+
+func (s *SessionSigner) issue(prefix []byte, userId uuid.UUID, ttl time.Duration) (string, time.Time) {
+	expiresAt := time.Now().UTC().Add(ttl).Truncate(time.Second)
+	payload := make([]byte, len(prefix)+16+8)
+	copy(payload, prefix)
+	copy(payload[len(prefix):], userId[:])
+	binary.BigEndian.PutUint64(payload[len(prefix)+16:], uint64(expiresAt.Unix()))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload)), expiresAt
+}
+
+func (s *SessionSigner) verify(prefix []byte, token string) (uuid.UUID, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return uuid.UUID{}, ErrInvalidSession
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(payload) != len(prefix)+16+8 || !bytes.HasPrefix(payload, prefix) {
+		return uuid.UUID{}, ErrInvalidSession
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, s.sign(payload)) {
+		return uuid.UUID{}, ErrInvalidSession
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(payload[len(prefix)+16:])) {
+		return uuid.UUID{}, ErrInvalidSession
+	}
+	var userId uuid.UUID
+	copy(userId[:], payload[len(prefix):len(prefix)+16])
+	return userId, nil
+}
+
+// Checks the request's `Authorization: Bearer <token>` header
+func (s *SessionSigner) VerifyRequest(r *http.Request) (uuid.UUID, error) {
+	return s.Verify(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+func (s *SessionSigner) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Rejects requests without a valid `Authorization: Bearer <token>` header.
+// Handlers behind it can get the caller with UserIdFromContext.
+func RequireSession(lgr *zap.Logger, signer *SessionSigner) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userId, err := signer.VerifyRequest(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				utils.ErrorResp(lgr, w, http.StatusUnauthorized, "Missing or invalid session token. Sign back in with POST /sessions/request/", err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userIdCtxKey, userId)))
+		})
+	}
+}
+
+func UserIdFromContext(ctx context.Context) (uuid.UUID, bool) {
+	userId, ok := ctx.Value(userIdCtxKey).(uuid.UUID)
+	return userId, ok
+}
@@ -5,11 +5,14 @@ import (
 	"net/http"
 )
 
+// Only applies to requests with a body. GETs (e.g. the brew sheet's ?format=text) and DELETEs don't have one,
+// so they're let through whatever their Content-Type says.
 func RequireJsonContentType(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("Executing Content-type middleware before the request phase!")
 
-		if r.Header.Get("Content-type") != "application/json" {
+		bodyless := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodDelete
+		if !bodyless && r.Header.Get("Content-type") != "application/json" {
 			w.WriteHeader(http.StatusUnsupportedMediaType)
 			w.Write([]byte("415 - Unsupported Media Type. Only JSON files are allowed"))
 			return
@@ -20,16 +23,30 @@ func RequireJsonContentType(next http.Handler) http.Handler {
 	})
 }
 
-func AccessControl(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT")
-		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type")
+// CORS headers. allowedOrigins of ["*"] lets anyone in, otherwise the request's Origin is echoed back if it's in the list.
+func AccessControl(allowedOrigins []string) func(http.Handler) http.Handler {
+	allowAny := false
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowAny = allowAny || origin == "*"
+		allowed[origin] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if allowAny {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else if origin := r.Header.Get("Origin"); allowed[origin] {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
 
-		if r.Method == "OPTIONS" {
-			return
-		}
+			if r.Method == "OPTIONS" {
+				return
+			}
 
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/ThePianoDentist/fancy-a-brew/fcm_client"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+)
+
+// Picks the notifier implementation by name. An empty kind means fcm if we've got credentials, otherwise just log.
+func NewNotifier(lgr *zap.Logger, kind, fcmCredentialsFile string) (notifier.Notifier, error) {
+	if kind == "" {
+		kind = notifier.KindLog
+		if fcmCredentialsFile != "" {
+			kind = notifier.KindFCM
+		}
+	}
+	switch kind {
+	case notifier.KindFCM:
+		if fcmCredentialsFile == "" {
+			return nil, fmt.Errorf("fcm notifier needs a credentials file")
+		}
+		fcm, err := fcm_client.NewFCMController(lgr, fcmCredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		return fcm, nil
+	case notifier.KindLog:
+		lgr.Warn("notifications will only be logged, not sent")
+		return notifier.NewLogNotifier(lgr), nil
+	case notifier.KindMemory:
+		lgr.Warn("notifications will only be recorded in memory, not sent")
+		return notifier.NewRecordingNotifier(), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q. expected one of %s, %s, %s", kind, notifier.KindFCM, notifier.KindLog, notifier.KindMemory)
+	}
+}
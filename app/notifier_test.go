@@ -0,0 +1,34 @@
+package app
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+)
+
+func TestNewNotifier(t *testing.T) {
+	lgr := zap.NewNop()
+
+	n, err := NewNotifier(lgr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.(*notifier.LogNotifier); !ok {
+		t.Errorf("no kind and no credentials should log, got %T", n)
+	}
+	n, err = NewNotifier(lgr, notifier.KindMemory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.(*notifier.RecordingNotifier); !ok {
+		t.Errorf("expected a *notifier.RecordingNotifier, got %T", n)
+	}
+	if _, err := NewNotifier(lgr, notifier.KindFCM, ""); err == nil {
+		t.Error("fcm without credentials should fail")
+	}
+	if _, err := NewNotifier(lgr, "carrier-pigeon", ""); err == nil {
+		t.Error("unknown kind should fail")
+	}
+}
@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ThePianoDentist/fancy-a-brew/app_context"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+)
+
+const (
+	DefaultRoundTimeout      = 15 * time.Minute
+	DefaultRoundReminderLead = 5 * time.Minute
+	DefaultSchedulerInterval = 30 * time.Second
+)
+
+// Background loop that keeps rounds from hanging around forever if the maker never hits /finished/.
+// Makers get a "where's my drink?" nudge ReminderLead before the round times out,
+// then once it times out the round is expired and everyone who ordered is told it's been abandoned.
+type RoundScheduler struct {
+	appCtx *app_context.AppContext
+	// how long a round can be active before it's expired
+	RoundTimeout time.Duration
+	// how long before expiry the maker gets reminded. 0 disables reminders
+	ReminderLead time.Duration
+	Interval     time.Duration
+}
+
+func NewRoundScheduler(appCtx *app_context.AppContext) *RoundScheduler {
+	return &RoundScheduler{
+		appCtx:       appCtx,
+		RoundTimeout: DefaultRoundTimeout,
+		ReminderLead: DefaultRoundReminderLead,
+		Interval:     DefaultSchedulerInterval,
+	}
+}
+
+func (s *RoundScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// ctx only says when to stop. a tick that's already going gets to finish rather than
+			// leaving a round expired with nobody told about it
+			s.tick(context.Background(), now.UTC())
+		}
+	}
+}
+
+func (s *RoundScheduler) tick(ctx context.Context, now time.Time) {
+	if s.ReminderLead > 0 && s.ReminderLead < s.RoundTimeout {
+		s.sendReminders(ctx, now.Add(-(s.RoundTimeout - s.ReminderLead)))
+	}
+	s.expireRounds(ctx, now.Add(-s.RoundTimeout))
+}
+
+func (s *RoundScheduler) sendReminders(ctx context.Context, offeredBefore time.Time) {
+	lgr := s.appCtx.Lgr
+	rounds, err := s.appCtx.Store.GetRoundsNeedingReminder(ctx, offeredBefore)
+	if err != nil {
+		lgr.Error("error getting rounds needing reminder", zap.Error(err))
+		return
+	}
+	for _, round := range rounds {
+		sent, err := s.appCtx.Store.MarkReminderSent(ctx, &round)
+		if err != nil {
+			lgr.Error("error marking round reminder sent", zap.String("roundId", round.RoundId.String()), zap.Error(err))
+			continue
+		}
+		if !sent {
+			continue
+		}
+		kettle, err := s.appCtx.Store.GetKettle(ctx, round.KettleId)
+		if err != nil {
+			lgr.Error("error getting kettle for reminder", zap.String("roundId", round.RoundId.String()), zap.Error(err))
+			continue
+		}
+		payload := notifier.ReminderPayload{
+			KettleId:   round.KettleId,
+			KettleName: kettle.Name,
+			RoundId:    round.RoundId,
+			Deadline:   round.OfferedAt.Add(s.RoundTimeout),
+		}
+		if _, err := s.appCtx.Outbox.Enqueue(ctx, []storage.User{{UserId: round.MakerId}}, payload); err != nil {
+			lgr.Error("error queueing notification", zap.Error(err))
+		}
+	}
+}
+
+func (s *RoundScheduler) expireRounds(ctx context.Context, offeredBefore time.Time) {
+	lgr := s.appCtx.Lgr
+	rounds, err := s.appCtx.Store.GetActiveRoundsOfferedBefore(ctx, offeredBefore)
+	if err != nil {
+		lgr.Error("error getting stale rounds", zap.Error(err))
+		return
+	}
+	for _, round := range rounds {
+		if err := s.appCtx.Store.TransitionRound(ctx, &round, storage.RoundExpired); err != nil {
+			// maker finished/cancelled it between us reading and updating. nothing to expire
+			if !errors.Is(err, storage.ErrIllegalTransition) {
+				lgr.Error("error expiring round", zap.String("roundId", round.RoundId.String()), zap.Error(err))
+			}
+			continue
+		}
+		lgr.Info("expired round", zap.String("roundId", round.RoundId.String()), zap.String("kettleId", round.KettleId.String()))
+		requests, err := s.appCtx.Store.GetRoundDrinkRequests(ctx, round.RoundId)
+		if err != nil {
+			lgr.Error("error getting drink requests for expired round", zap.String("roundId", round.RoundId.String()), zap.Error(err))
+			continue
+		}
+		kettle, err := s.appCtx.Store.GetKettle(ctx, round.KettleId)
+		if err != nil {
+			lgr.Error("error getting kettle for expired round", zap.String("roundId", round.RoundId.String()), zap.Error(err))
+			continue
+		}
+		maker, err := s.appCtx.Store.GetUser(ctx, round.MakerId)
+		if err != nil {
+			lgr.Error("error getting maker for expired round", zap.String("roundId", round.RoundId.String()), zap.Error(err))
+			continue
+		}
+		payload := notifier.RoundExpiredPayload{
+			KettleId:      round.KettleId,
+			KettleName:    kettle.Name,
+			RoundId:       round.RoundId,
+			MakerId:       round.MakerId,
+			MakerNickname: maker.DefaultNickname,
+		}
+		drinkers := make([]storage.User, 0, len(requests))
+		for _, dr := range requests {
+			// the maker ordering from their own round doesn't need telling they never finished it
+			if dr.UserId != round.MakerId {
+				drinkers = append(drinkers, storage.User{UserId: dr.UserId})
+			}
+		}
+		if _, err := s.appCtx.Outbox.Enqueue(ctx, drinkers, payload); err != nil {
+			lgr.Error("error queueing notifications", zap.Error(err))
+		}
+	}
+}
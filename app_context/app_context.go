@@ -1,10 +1,12 @@
 package app_context
 
 import (
-	"database/sql"
 	"net/http"
 
-	"github.com/ThePianoDentist/fancy-a-brew/fcm_client"
+	"github.com/ThePianoDentist/fancy-a-brew/app/middleware"
+	"github.com/ThePianoDentist/fancy-a-brew/config"
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
 
 	"go.uber.org/zap"
 
@@ -23,8 +25,12 @@ func (h *CtxHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type AppContext struct {
-	Lgr           *zap.Logger
-	Hub           *ws.Hub
-	DB            *sql.DB
-	FcmController *fcm_client.FCMController
+	Lgr      *zap.Logger
+	Hub      *ws.Hub
+	Store    storage.Store
+	Cfg      *config.Config
+	Notifier notifier.Notifier
+	// how handlers and the scheduler should send notifications. Notifier is only for the outbox to send through
+	Outbox   *notifier.Outbox
+	Sessions *middleware.SessionSigner
 }
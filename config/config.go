@@ -0,0 +1,419 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
+)
+
+// Everything the server needs to start. Load fills it from (in increasing priority) Default(), an optional YAML
+// file, then APP_* env vars, and validates the result.
+type Config struct {
+	ListenAddr string `yaml:"listen_addr"`
+	LogLevel   string `yaml:"log_level"`
+	// for running locally. allows an empty session_secret
+	Dev bool `yaml:"dev"`
+	// signs session tokens. required unless dev is set, in which case an empty one means a random one is generated
+	// on startup (and everyone has to sign back in whenever the server restarts)
+	SessionSecret string `yaml:"session_secret"`
+	// origins allowed to make CORS requests. "*" allows anyone
+	CORSOrigins []string `yaml:"cors_origins"`
+	// how far from a kettle people get told about offers
+	NotificationRadiusMetres int32          `yaml:"notification_radius_metres"`
+	HTTP                     HTTPConfig     `yaml:"http"`
+	DB                       DBConfig       `yaml:"db"`
+	Notifier                 NotifierConfig `yaml:"notifier"`
+	Rounds                   RoundsConfig   `yaml:"rounds"`
+	Rota                     RotaConfig     `yaml:"rota"`
+}
+
+type HTTPConfig struct {
+	ReadTimeout  Duration `yaml:"read_timeout"`
+	WriteTimeout Duration `yaml:"write_timeout"`
+	IdleTimeout  Duration `yaml:"idle_timeout"`
+	// how long in-flight requests and background work get to finish on SIGINT/SIGTERM before we give up on them
+	ShutdownTimeout Duration `yaml:"shutdown_timeout"`
+	// separate listener for /debug/vars (notification counters, go runtime stats). empty means it's not served at all.
+	// keep it somewhere only you can reach, e.g. 127.0.0.1:8082
+	AdminAddr string `yaml:"admin_addr"`
+}
+
+type DBConfig struct {
+	// postgres, or memory to keep everything in-process (nothing survives a restart, handy without a PostGIS server)
+	Driver          string   `yaml:"driver"`
+	Host            string   `yaml:"host"`
+	Port            int      `yaml:"port"`
+	User            string   `yaml:"user"`
+	Password        string   `yaml:"password"`
+	Name            string   `yaml:"name"`
+	SSLMode         string   `yaml:"sslmode"`
+	MaxConns        int32    `yaml:"max_conns"`
+	MinConns        int32    `yaml:"min_conns"`
+	ConnMaxLifetime Duration `yaml:"conn_max_lifetime"`
+	// upper bound on any single query/transaction
+	QueryTimeout Duration `yaml:"query_timeout"`
+	// apply pending migrations on startup. if off, run `fancy-a-brew migrate up` yourself
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+type NotifierConfig struct {
+	// fcm, log or memory. empty means fcm if there's a credentials file, otherwise log
+	Kind               string `yaml:"kind"`
+	FCMCredentialsFile string `yaml:"fcm_credentials_file"`
+	// how many notifications can be sending at once
+	Workers int `yaml:"workers"`
+	// how many queued notifications a worker pass picks up. with fcm, ones with the same message go out as one multicast
+	BatchSize int `yaml:"batch_size"`
+	// sends are retried with exponential backoff, from retry_backoff up to max_retry_backoff, until max_attempts
+	MaxAttempts     int      `yaml:"max_attempts"`
+	RetryBackoff    Duration `yaml:"retry_backoff"`
+	MaxRetryBackoff Duration `yaml:"max_retry_backoff"`
+	// how often to look for retries that have come due
+	PollInterval Duration `yaml:"poll_interval"`
+	// how long a single send to fcm gets before it's given up on (and retried)
+	SendTimeout Duration `yaml:"send_timeout"`
+}
+
+type RotaConfig struct {
+	// when someone asks for a round and nobody's making, nudge whoever's most in tea debt to put the kettle on
+	Nudge bool `yaml:"nudge"`
+	// a kettle's members get nudged at most this often
+	NudgeCooldown Duration `yaml:"nudge_cooldown"`
+}
+
+type RoundsConfig struct {
+	// how long a round can be active before it's expired
+	Timeout Duration `yaml:"timeout"`
+	// how long before expiry the maker gets a reminder. 0 disables reminders
+	ReminderLead Duration `yaml:"reminder_lead"`
+	// how often to check for rounds to remind/expire
+	CheckInterval Duration `yaml:"check_interval"`
+	// how long a round has to be left untouched before someone else can take it over
+	TakeOverAfter Duration `yaml:"take_over_after"`
+}
+
+// time.Duration that can be written as "15m" in YAML
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func Default() *Config {
+	return &Config{
+		ListenAddr:               "0.0.0.0:8081",
+		LogLevel:                 "info",
+		CORSOrigins:              []string{"*"},
+		NotificationRadiusMetres: 100,
+		HTTP: HTTPConfig{
+			ReadTimeout:     Duration(10 * time.Second),
+			WriteTimeout:    Duration(15 * time.Second),
+			IdleTimeout:     Duration(60 * time.Second),
+			ShutdownTimeout: Duration(20 * time.Second),
+		},
+		DB: DBConfig{
+			Driver:          "postgres",
+			Host:            "localhost",
+			Port:            5432,
+			SSLMode:         "disable",
+			MaxConns:        10,
+			MinConns:        1,
+			ConnMaxLifetime: Duration(30 * time.Minute),
+			QueryTimeout:    Duration(5 * time.Second),
+			AutoMigrate:     true,
+		},
+		Notifier: NotifierConfig{
+			Workers:         8,
+			BatchSize:       500,
+			MaxAttempts:     5,
+			RetryBackoff:    Duration(5 * time.Second),
+			MaxRetryBackoff: Duration(10 * time.Minute),
+			PollInterval:    Duration(5 * time.Second),
+			SendTimeout:     Duration(10 * time.Second),
+		},
+		Rounds: RoundsConfig{
+			Timeout:       Duration(15 * time.Minute),
+			ReminderLead:  Duration(5 * time.Minute),
+			CheckInterval: Duration(30 * time.Second),
+			TakeOverAfter: Duration(5 * time.Minute),
+		},
+		Rota: RotaConfig{
+			Nudge:         true,
+			NudgeCooldown: Duration(15 * time.Minute),
+		},
+	}
+}
+
+// path can be empty, in which case it's just defaults + env
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(raw, cfg); err != nil {
+			return nil, fmt.Errorf("error parsing config file %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() error {
+	strVars := map[string]*string{
+		"APP_LISTEN_ADDR":     &c.ListenAddr,
+		"APP_LOG_LEVEL":       &c.LogLevel,
+		"APP_SESSION_SECRET":  &c.SessionSecret,
+		"APP_DB_DRIVER":       &c.DB.Driver,
+		"APP_DB_HOST":         &c.DB.Host,
+		"APP_DB_USERNAME":     &c.DB.User,
+		"APP_DB_PASSWORD":     &c.DB.Password,
+		"APP_DB_NAME":         &c.DB.Name,
+		"APP_DB_SSLMODE":      &c.DB.SSLMode,
+		"APP_NOTIFIER":        &c.Notifier.Kind,
+		"APP_FCM_CREDENTIALS": &c.Notifier.FCMCredentialsFile,
+		"APP_HTTP_ADMIN_ADDR": &c.HTTP.AdminAddr,
+	}
+	for name, field := range strVars {
+		if val, ok := os.LookupEnv(name); ok {
+			*field = val
+		}
+	}
+
+	intVars := map[string]*int{
+		"APP_DB_PORT":               &c.DB.Port,
+		"APP_NOTIFIER_WORKERS":      &c.Notifier.Workers,
+		"APP_NOTIFIER_BATCH_SIZE":   &c.Notifier.BatchSize,
+		"APP_NOTIFIER_MAX_ATTEMPTS": &c.Notifier.MaxAttempts,
+	}
+	for name, field := range intVars {
+		if val, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("%s should be a whole number: %w", name, err)
+			}
+			*field = parsed
+		}
+	}
+	int32Vars := map[string]*int32{
+		"APP_DB_MAX_CONNS": &c.DB.MaxConns,
+		"APP_DB_MIN_CONNS": &c.DB.MinConns,
+	}
+	for name, field := range int32Vars {
+		if val, ok := os.LookupEnv(name); ok {
+			parsed, err := strconv.ParseInt(val, 10, 32)
+			if err != nil {
+				return fmt.Errorf("%s should be a whole number: %w", name, err)
+			}
+			*field = int32(parsed)
+		}
+	}
+
+	durationVars := map[string]*Duration{
+		"APP_HTTP_READ_TIMEOUT":     &c.HTTP.ReadTimeout,
+		"APP_HTTP_WRITE_TIMEOUT":    &c.HTTP.WriteTimeout,
+		"APP_HTTP_IDLE_TIMEOUT":     &c.HTTP.IdleTimeout,
+		"APP_HTTP_SHUTDOWN_TIMEOUT": &c.HTTP.ShutdownTimeout,
+		"APP_DB_CONN_MAX_LIFETIME":  &c.DB.ConnMaxLifetime,
+		"APP_DB_QUERY_TIMEOUT":      &c.DB.QueryTimeout,
+		"APP_ROUND_TIMEOUT":         &c.Rounds.Timeout,
+		"APP_ROUND_REMINDER_LEAD":   &c.Rounds.ReminderLead,
+		"APP_ROUND_CHECK_INTERVAL":  &c.Rounds.CheckInterval,
+		"APP_ROUND_TAKE_OVER_AFTER": &c.Rounds.TakeOverAfter,
+		"APP_ROTA_NUDGE_COOLDOWN":   &c.Rota.NudgeCooldown,
+		"APP_NOTIFIER_SEND_TIMEOUT": &c.Notifier.SendTimeout,
+	}
+	for name, field := range durationVars {
+		if val, ok := os.LookupEnv(name); ok {
+			parsed, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("%s should be a duration like 15m: %w", name, err)
+			}
+			*field = Duration(parsed)
+		}
+	}
+
+	if val, ok := os.LookupEnv("APP_NOTIFICATION_RADIUS"); ok {
+		parsed, err := strconv.ParseInt(val, 10, 32)
+		if err != nil {
+			return fmt.Errorf("APP_NOTIFICATION_RADIUS should be a whole number of metres: %w", err)
+		}
+		c.NotificationRadiusMetres = int32(parsed)
+	}
+	if val, ok := os.LookupEnv("APP_DEV"); ok {
+		parsed, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("APP_DEV should be true or false: %w", err)
+		}
+		c.Dev = parsed
+	}
+	if val, ok := os.LookupEnv("APP_DB_AUTO_MIGRATE"); ok {
+		parsed, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("APP_DB_AUTO_MIGRATE should be true or false: %w", err)
+		}
+		c.DB.AutoMigrate = parsed
+	}
+	if val, ok := os.LookupEnv("APP_ROTA_NUDGE"); ok {
+		parsed, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("APP_ROTA_NUDGE should be true or false: %w", err)
+		}
+		c.Rota.Nudge = parsed
+	}
+	if val, ok := os.LookupEnv("APP_CORS_ORIGINS"); ok {
+		c.CORSOrigins = strings.Split(val, ",")
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("invalid listen_addr %q: %w", c.ListenAddr, err)
+	}
+	if _, err := c.ZapLevel(); err != nil {
+		return fmt.Errorf("invalid log_level %q: %w", c.LogLevel, err)
+	}
+	if len(c.CORSOrigins) == 0 {
+		return fmt.Errorf("cors_origins can't be empty. use \"*\" to allow any origin")
+	}
+	if c.NotificationRadiusMetres <= 0 {
+		return fmt.Errorf("notification_radius_metres must be positive, got %d", c.NotificationRadiusMetres)
+	}
+	if c.HTTP.ReadTimeout <= 0 || c.HTTP.WriteTimeout <= 0 || c.HTTP.IdleTimeout <= 0 || c.HTTP.ShutdownTimeout <= 0 {
+		return fmt.Errorf("http read_timeout, write_timeout, idle_timeout and shutdown_timeout must all be positive")
+	}
+	if c.HTTP.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.AdminAddr); err != nil {
+			return fmt.Errorf("invalid http.admin_addr %q: %w", c.HTTP.AdminAddr, err)
+		}
+		if c.HTTP.AdminAddr == c.ListenAddr {
+			return fmt.Errorf("http.admin_addr has to be different to listen_addr")
+		}
+	}
+	if err := c.DB.Validate(); err != nil {
+		return err
+	}
+	switch c.Notifier.Kind {
+	case "", "log", "memory":
+	case "fcm":
+		if c.Notifier.FCMCredentialsFile == "" {
+			return fmt.Errorf("notifier.fcm_credentials_file is required for the fcm notifier")
+		}
+	default:
+		return fmt.Errorf("unknown notifier.kind %q. expected fcm, log or memory", c.Notifier.Kind)
+	}
+	if c.Notifier.Workers < 1 || c.Notifier.BatchSize < 1 || c.Notifier.MaxAttempts < 1 {
+		return fmt.Errorf("notifier.workers, notifier.batch_size and notifier.max_attempts must be at least 1")
+	}
+	if c.Notifier.RetryBackoff <= 0 || c.Notifier.MaxRetryBackoff < c.Notifier.RetryBackoff {
+		return fmt.Errorf("notifier.retry_backoff must be positive and no more than notifier.max_retry_backoff")
+	}
+	if c.Notifier.PollInterval <= 0 {
+		return fmt.Errorf("notifier.poll_interval must be positive")
+	}
+	// the outbox takes a minute's lease on each notification right before sending it. a send that could outlast
+	// that might be claimed and sent again while it's still going
+	if c.Notifier.SendTimeout <= 0 || c.Notifier.SendTimeout >= Duration(time.Minute) {
+		return fmt.Errorf("notifier.send_timeout must be positive and less than a minute")
+	}
+	if c.Rounds.Timeout <= 0 {
+		return fmt.Errorf("rounds.timeout must be positive")
+	}
+	if c.Rounds.ReminderLead < 0 || c.Rounds.ReminderLead >= c.Rounds.Timeout {
+		return fmt.Errorf("rounds.reminder_lead must be between 0 and rounds.timeout")
+	}
+	if c.Rounds.CheckInterval <= 0 {
+		return fmt.Errorf("rounds.check_interval must be positive")
+	}
+	if c.Rounds.TakeOverAfter < 0 {
+		return fmt.Errorf("rounds.take_over_after can't be negative")
+	}
+	if c.Rota.NudgeCooldown < 0 {
+		return fmt.Errorf("rota.nudge_cooldown can't be negative")
+	}
+	return nil
+}
+
+func (c *Config) ZapLevel() (zapcore.Level, error) {
+	var level zapcore.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+var validSSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+func (c *DBConfig) Validate() error {
+	switch c.Driver {
+	case "memory":
+		return nil
+	case "postgres":
+	default:
+		return fmt.Errorf("unknown db.driver %q. expected postgres or memory", c.Driver)
+	}
+	if c.Host == "" {
+		return fmt.Errorf("db.host is required")
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid db.port %d", c.Port)
+	}
+	if c.User == "" || c.Name == "" {
+		return fmt.Errorf("db.user and db.name are required (APP_DB_USERNAME, APP_DB_NAME)")
+	}
+	validMode := false
+	for _, mode := range validSSLModes {
+		validMode = validMode || mode == c.SSLMode
+	}
+	if !validMode {
+		return fmt.Errorf("invalid db.sslmode %q. expected one of %s", c.SSLMode, strings.Join(validSSLModes, ", "))
+	}
+	if c.MaxConns < 1 || c.MinConns < 0 {
+		return fmt.Errorf("db.max_conns must be at least 1 and db.min_conns can't be negative")
+	}
+	if c.MinConns > c.MaxConns {
+		return fmt.Errorf("db.min_conns (%d) can't be more than db.max_conns (%d)", c.MinConns, c.MaxConns)
+	}
+	if c.QueryTimeout <= 0 {
+		return fmt.Errorf("db.query_timeout must be positive")
+	}
+	return nil
+}
+
+// postgres:// url, so passwords with spaces/symbols don't need any special quoting
+func (c *DBConfig) ConnectionString() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:     c.Name,
+		RawQuery: url.Values{"sslmode": {c.SSLMode}}.Encode(),
+	}
+	return u.String()
+}
@@ -2,10 +2,13 @@ package fcm_client
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"strings"
 
 	"go.uber.org/zap"
 
+	"github.com/ThePianoDentist/fancy-a-brew/notifier"
+
 	"google.golang.org/api/option"
 
 	firebase "firebase.google.com/go/v4"
@@ -13,12 +16,15 @@ import (
 	"firebase.google.com/go/v4/messaging"
 )
 
+// most tokens FCM takes in one multicast call
+const MaxMulticastTokens = 500
+
 type FCMController struct {
 	Client *messaging.Client
 	Lgr    *zap.Logger
 }
 
-func NewFCMController(lgr *zap.Logger) *FCMController {
+func NewFCMController(lgr *zap.Logger, credentialsFile string) (*FCMController, error) {
 	//config := firebase.Config{
 	//	AuthOverride:     nil,
 	//	DatabaseURL:      "",
@@ -26,33 +32,100 @@ func NewFCMController(lgr *zap.Logger) *FCMController {
 	//	ServiceAccountID: "",
 	//	StorageBucket:    "",
 	//}
-	// TODO update this.
-	opt := option.WithCredentialsFile("/home/johnnyk/Documents/serviceAccountKey.json")
+	opt := option.WithCredentialsFile(credentialsFile)
 	app, err := firebase.NewApp(context.Background(), nil, opt)
 	if err != nil {
-		log.Fatalf("error initializing app: %v\n", err)
+		return nil, fmt.Errorf("error initializing firebase app: %w", err)
 	}
 	ctx := context.Background()
 	client, err := app.Messaging(ctx)
 	if err != nil {
-		log.Fatalf("error getting Messaging client: %v\n", err)
+		return nil, fmt.Errorf("error getting Messaging client: %w", err)
 	}
-	return &FCMController{Client: client, Lgr: lgr}
+	return &FCMController{Client: client, Lgr: lgr}, nil
 }
 
-func (c *FCMController) SendFCM(toToken string, data map[string]string) error {
+func (c *FCMController) Send(ctx context.Context, toToken string, msg notifier.Message) error {
 	c.Lgr.Info("Sending fcm message to ", zap.String("To", toToken))
 	message := &messaging.Message{
-		Data:  data,
-		Token: toToken,
+		Data:         msg.Data,
+		Notification: notification(msg),
+		Token:        toToken,
 	}
 
 	// Send a message to the device corresponding to the provided registration token.
-	response, err := c.Client.Send(context.Background(), message)
+	response, err := c.Client.Send(ctx, message)
 	if err != nil {
-		return err
+		return classify(err)
 	}
 	// Response is a message ID string.
 	c.Lgr.Info("Successfully sent fcm message:", zap.String("resp", response), zap.String("To", toToken))
 	return nil
 }
+
+func (c *FCMController) Kind() string {
+	return notifier.KindFCM
+}
+
+// Sends the same message to every token, MaxMulticastTokens at a time. Returns an error per token in the same order,
+// nil where it went through. If a whole batch fails every token in it gets that error.
+func (c *FCMController) SendMulticast(ctx context.Context, toTokens []string, msg notifier.Message) []error {
+	errs := make([]error, len(toTokens))
+	for start := 0; start < len(toTokens); start += MaxMulticastTokens {
+		end := start + MaxMulticastTokens
+		if end > len(toTokens) {
+			end = len(toTokens)
+		}
+		batch := toTokens[start:end]
+		response, err := c.Client.SendMulticast(ctx, &messaging.MulticastMessage{Data: msg.Data, Notification: notification(msg), Tokens: batch})
+		if err != nil {
+			for i := range batch {
+				errs[start+i] = classify(err)
+			}
+			continue
+		}
+		// responses come back in the same order as the tokens
+		for i, resp := range response.Responses {
+			if !resp.Success {
+				errs[start+i] = classify(resp.Error)
+			}
+		}
+		c.Lgr.Info("sent fcm multicast", zap.Int("successes", response.SuccessCount), zap.Int("failures", response.FailureCount))
+	}
+	return errs
+}
+
+// the bit the phone displays by itself. nil if there's nothing to show, making it a data-only message
+func notification(msg notifier.Message) *messaging.Notification {
+	if msg.Title == "" && msg.Body == "" {
+		return nil
+	}
+	return &messaging.Notification{Title: msg.Title, Body: msg.Body}
+}
+
+// Wraps FCM errors that aren't worth retrying in the notifier errors the outbox understands.
+// Only errors that are definitely about the token itself count as ErrInvalidToken, as those get the device pruned.
+func classify(err error) error {
+	switch {
+	case messaging.IsUnregistered(err):
+		return fmt.Errorf("%w: %v", notifier.ErrInvalidToken, err)
+	case messaging.IsInvalidArgument(err) && isBadTokenMessage(err):
+		return fmt.Errorf("%w: %v", notifier.ErrInvalidToken, err)
+	case messaging.IsInvalidArgument(err):
+		// something wrong with the message (too big, bad data key...). sending it again won't help,
+		// but it's our fault not the device's, so the token stays
+		return fmt.Errorf("%w: %v", notifier.ErrPermanent, err)
+	case messaging.IsSenderIDMismatch(err), messaging.IsThirdPartyAuthError(err):
+		// usually our credentials/project being wrong, which would look like every token being bad
+		return fmt.Errorf("%w: %v", notifier.ErrPermanent, err)
+	default:
+		// unavailable, internal, quota exceeded, network trouble etc.
+		return err
+	}
+}
+
+// FCM reports a malformed token as INVALID_ARGUMENT, same as a malformed message. The only way to tell them
+// apart is the message, e.g. "The registration token is not a valid FCM registration token"
+func isBadTokenMessage(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "registration token")
+}
@@ -1,16 +1,18 @@
 module github.com/ThePianoDentist/fancy-a-brew
 
-go 1.14
+go 1.16
 
 require (
 	firebase.google.com/go/v4 v4.1.0
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
+	github.com/jackc/pgconn v1.8.0
+	github.com/jackc/pgtype v1.6.2
 	github.com/jackc/pgx/v4 v4.10.1
-	github.com/lib/pq v1.9.0
-	github.com/stretchr/testify v1.5.1 // indirect
+	github.com/lib/pq v1.9.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.16.0
 	google.golang.org/api v0.36.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -1,27 +1,135 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/ThePianoDentist/fancy-a-brew/app"
+	"github.com/ThePianoDentist/fancy-a-brew/config"
+	"github.com/ThePianoDentist/fancy-a-brew/migrations"
 
 	"go.uber.org/zap"
 )
 
+const usage = `usage: fancy-a-brew [-config path] [command]
+
+commands:
+  serve              run the server (default)
+  migrate up         apply all pending migrations
+  migrate down [n]   roll back the newest n migrations (default 1)
+  migrate version    print the current schema version
+`
+
 func main() {
-	lgr, _ := zap.NewProduction()
+	os.Exit(run())
+}
+
+// Everything main does, returning the exit code rather than exiting so the deferred log flush still happens.
+func run() int {
+	configPath := flag.String("config", os.Getenv("APP_CONFIG"), "path to a YAML config file. APP_* env vars override anything in it")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Printf("error loading config: %v", err)
+		return 1
+	}
+	lgr := newLogger(cfg)
 	defer lgr.Sync()
-	fmt.Println("APP_DB_PASSWORD:")
-	fmt.Println(os.Getenv("APP_DB_PASSWORD"))
-	a := app.NewApp(
-		lgr,
-		os.Getenv("APP_DB_USERNAME"),
-		os.Getenv("APP_DB_PASSWORD"),
-		os.Getenv("APP_DB_NAME"),
-	)
-
-	a.Run("0.0.0.0:8081")
-
-	fmt.Println("vim-go")
+
+	switch flag.Arg(0) {
+	case "", "serve":
+		a, err := app.NewApp(lgr, cfg)
+		if err != nil {
+			lgr.Error("error setting up app", zap.Error(err))
+			return 1
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := a.Run(ctx); err != nil {
+			lgr.Error("error running server", zap.Error(err))
+			return 1
+		}
+		lgr.Info("shut down cleanly")
+	case "migrate":
+		if err := migrate(lgr, cfg, flag.Args()[1:]); err != nil {
+			lgr.Error("error migrating", zap.Error(err))
+			return 1
+		}
+	default:
+		flag.Usage()
+		return 2
+	}
+	return 0
+}
+
+func migrate(lgr *zap.Logger, cfg *config.Config, args []string) error {
+	if cfg.DB.Driver != "postgres" {
+		return fmt.Errorf("nothing to migrate with the %s db driver", cfg.DB.Driver)
+	}
+	ctx := context.Background()
+	pool, err := app.OpenDB(ctx, cfg.DB)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	migrator, err := migrations.NewMigrator(pool, lgr)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("migrate needs one of up, down, version")
+	}
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		lgr.Info("migrated up", zap.Int("applied", applied))
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("migrate down wants a positive number of steps, got %q", args[1])
+			}
+		}
+		rolledBack, err := migrator.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+		lgr.Info("migrated down", zap.Int("rolledBack", rolledBack))
+	case "version":
+		version, err := migrator.Version(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(version)
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+	return nil
+}
+
+func newLogger(cfg *config.Config) *zap.Logger {
+	// already validated, so can ignore the error
+	level, _ := cfg.ZapLevel()
+	zapCfg := zap.NewProductionConfig()
+	zapCfg.Level = zap.NewAtomicLevelAt(level)
+	lgr, err := zapCfg.Build()
+	if err != nil {
+		log.Fatalf("error building logger: %v", err)
+	}
+	return lgr
 }
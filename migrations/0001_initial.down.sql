@@ -0,0 +1,2 @@
+DROP TABLE kettles;
+DROP TABLE appusers;
@@ -1,7 +1,5 @@
-
--- extension needs to be added as admin (i.e. postgres user)
-CREATE EXTENSION IF NOT EXISTS pgcrypto;
-CREATE EXTENSION IF NOT EXISTS postgis;
+-- postgis and pgcrypto must already exist (CREATE EXTENSION needs the postgres superuser),
+-- the migrator checks for them before running anything.
 CREATE TABLE appusers(
     user_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     -- why not just use firebase_token as primary-key if that's unique?
@@ -25,4 +23,4 @@ CREATE TABLE kettles(
 
 CREATE INDEX users_location_gix ON appusers USING GIST (last_known_location);
 CREATE INDEX kettles_location_gix ON kettles USING GIST (location);
-CREATE INDEX kettles_appusers ON kettles(current_maker);
\ No newline at end of file
+CREATE INDEX kettles_appusers ON kettles(current_maker);
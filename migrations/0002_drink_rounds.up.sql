@@ -0,0 +1,16 @@
+CREATE TABLE drink_rounds(
+    round_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    kettle_id UUID NOT NULL REFERENCES kettles,
+    maker_id UUID NOT NULL REFERENCES appusers,
+    -- offered -> collecting -> brewing -> delivered. or cancelled/expired from any of the active ones.
+    state TEXT NOT NULL DEFAULT 'offered',
+    offered_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ,
+    -- set once the maker has been sent a "where's my drink?" nudge, so they only get one
+    reminder_sent_at TIMESTAMPTZ
+);
+
+-- only one active round per kettle. stops two people offering at the same time.
+CREATE UNIQUE INDEX drink_rounds_one_active ON drink_rounds(kettle_id) WHERE state IN ('offered', 'collecting', 'brewing');
+CREATE INDEX drink_rounds_maker ON drink_rounds(maker_id);
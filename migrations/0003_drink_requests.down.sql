@@ -0,0 +1 @@
+DROP TABLE drink_requests;
@@ -0,0 +1,14 @@
+CREATE TABLE drink_requests(
+    request_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    round_id UUID NOT NULL REFERENCES drink_rounds,
+    user_id UUID NOT NULL REFERENCES appusers,
+    -- what they actually want. if the_usual_ticked this is copied from appusers.the_usual at request time,
+    -- so changing your usual later doesn't rewrite history.
+    choice TEXT NOT NULL,
+    the_usual_ticked BOOLEAN NOT NULL DEFAULT false,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- one drink each. responding again just changes your order
+    UNIQUE(round_id, user_id)
+);
+
+CREATE INDEX drink_requests_user ON drink_requests(user_id);
@@ -0,0 +1,2 @@
+ALTER TABLE kettles DROP COLUMN notify_mode;
+DROP TABLE kettle_members;
@@ -0,0 +1,12 @@
+CREATE TABLE kettle_members(
+    kettle_id UUID NOT NULL REFERENCES kettles ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES appusers ON DELETE CASCADE,
+    joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (kettle_id, user_id)
+);
+
+CREATE INDEX kettle_members_user ON kettle_members(user_id);
+
+-- who gets told about offers. 'nearby' (anyone within the radius, the original behaviour),
+-- 'members' (members wherever they are) or 'nearby_members' (members within the radius)
+ALTER TABLE kettles ADD COLUMN notify_mode TEXT NOT NULL DEFAULT 'nearby';
@@ -0,0 +1,20 @@
+-- every push notification goes through here rather than straight to FCM, so requests don't wait on it and
+-- failures get retried. one row per recipient.
+CREATE TABLE notification_outbox(
+    notification_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES appusers ON DELETE CASCADE,
+    token TEXT NOT NULL,
+    data JSONB NOT NULL,
+    -- pending -> sent, or failed once we've given up retrying
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    -- when a worker may (next) pick it up. bumped while a worker has it, so a crashed worker's sends get retried
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX notification_outbox_due ON notification_outbox(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX notification_outbox_user ON notification_outbox(user_id);
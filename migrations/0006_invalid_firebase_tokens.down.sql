@@ -0,0 +1 @@
+ALTER TABLE appusers DROP COLUMN firebase_token_invalid_since;
@@ -0,0 +1,3 @@
+-- set when FCM tells us the token is dead (app uninstalled, token rotated...), so offers stop going to it.
+-- cleared if the same token gets registered again.
+ALTER TABLE appusers ADD COLUMN firebase_token_invalid_since TIMESTAMPTZ;
@@ -0,0 +1,15 @@
+ALTER TABLE appusers ADD COLUMN firebase_token TEXT, ADD COLUMN firebase_token_invalid_since TIMESTAMPTZ;
+
+-- one token per user again, the most recently registered device wins
+UPDATE appusers u SET firebase_token = d.firebase_token, firebase_token_invalid_since = d.invalid_since
+FROM (
+    SELECT DISTINCT ON (user_id) user_id, firebase_token, invalid_since FROM user_devices ORDER BY user_id, registered_at DESC
+) d
+WHERE d.user_id = u.user_id;
+
+-- users with no devices still need a token. a placeholder that's already marked dead never gets sent anything
+UPDATE appusers SET firebase_token = 'no-device-' || user_id, firebase_token_invalid_since = now() WHERE firebase_token IS NULL;
+
+ALTER TABLE appusers ALTER COLUMN firebase_token SET NOT NULL, ADD CONSTRAINT appusers_firebase_token_key UNIQUE (firebase_token);
+
+DROP TABLE user_devices;
@@ -0,0 +1,19 @@
+-- firebase tokens move out of appusers, so a user can have several devices (phone + tablet) and a token being
+-- refreshed no longer turns them into a brand-new user
+CREATE TABLE user_devices(
+    device_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES appusers ON DELETE CASCADE,
+    firebase_token TEXT UNIQUE NOT NULL,
+    -- whatever the app calls it, e.g. "Pixel 5". only for showing in the device list
+    name TEXT NOT NULL DEFAULT '',
+    registered_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- set when FCM tells us the token is dead. cleared if it gets registered again
+    invalid_since TIMESTAMPTZ
+);
+
+CREATE INDEX user_devices_user ON user_devices(user_id);
+
+INSERT INTO user_devices(user_id, firebase_token, invalid_since)
+SELECT user_id, firebase_token, firebase_token_invalid_since FROM appusers;
+
+ALTER TABLE appusers DROP COLUMN firebase_token, DROP COLUMN firebase_token_invalid_since;
@@ -0,0 +1 @@
+ALTER TABLE notification_outbox DROP COLUMN title, DROP COLUMN body;
@@ -0,0 +1,2 @@
+-- what the phone shows by itself, so notifications make sense without the app running
+ALTER TABLE notification_outbox ADD COLUMN title TEXT NOT NULL DEFAULT '', ADD COLUMN body TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE drink_requests DROP COLUMN done_at;
@@ -0,0 +1,3 @@
+-- set when the maker ticks this drink off. if they tick any off, the ones left unticked when the round's
+-- finished didn't get made
+ALTER TABLE drink_requests ADD COLUMN done_at TIMESTAMPTZ;
@@ -0,0 +1,2 @@
+ALTER TABLE drink_requests DROP COLUMN drink_order;
+ALTER TABLE appusers DROP COLUMN the_usual_order;
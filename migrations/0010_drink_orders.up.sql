@@ -0,0 +1,4 @@
+-- structured versions of the_usual / choice (see storage.DrinkOrder). NULL for free text from old app versions,
+-- the text columns are still filled in either way so there's always something to show
+ALTER TABLE appusers ADD COLUMN the_usual_order JSONB;
+ALTER TABLE drink_requests ADD COLUMN drink_order JSONB;
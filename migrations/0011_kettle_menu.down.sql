@@ -0,0 +1 @@
+DROP TABLE kettle_menu_items;
@@ -0,0 +1,12 @@
+-- what a kettle can make. a kettle with no rows here hasn't said, so any order goes.
+-- items use the same names as storage.DrinkOrder, e.g. ('drink', 'coffee'), ('milk', 'oat'), ('sweetener', 'sugar')
+CREATE TABLE kettle_menu_items(
+    kettle_id UUID NOT NULL REFERENCES kettles ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    item TEXT NOT NULL,
+    -- any member can mark something as run out (or back in)
+    in_stock BOOLEAN NOT NULL DEFAULT true,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_by UUID REFERENCES appusers ON DELETE SET NULL,
+    PRIMARY KEY (kettle_id, kind, item)
+);
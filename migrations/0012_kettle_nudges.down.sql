@@ -0,0 +1 @@
+ALTER TABLE kettles DROP COLUMN last_nudged_at;
@@ -0,0 +1,2 @@
+-- when the kettle's most indebted member was last nudged to make a round, so they don't get pestered
+ALTER TABLE kettles ADD COLUMN last_nudged_at TIMESTAMPTZ;
@@ -0,0 +1,262 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+)
+
+// Migrations live next to this file as NNNN_name.up.sql / NNNN_name.down.sql and get compiled into the binary.
+//
+//go:embed *.sql
+var files embed.FS
+
+// Extensions the schema relies on. Creating them needs the postgres superuser, so we don't try,
+// we just refuse to run if they're missing.
+var RequiredExtensions = []string{"pgcrypto", "postgis"}
+
+// arbitrary, just needs to be the same for every instance so two servers starting at once don't both migrate
+const advisoryLockId = 7156231
+
+var fileNameRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// All embedded migrations, oldest first
+func Load() ([]Migration, error) {
+	entries, err := files.ReadDir(".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileNameRe.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("badly named migration file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		raw, err := files.ReadFile(path.Join(".", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(raw)
+		} else {
+			m.Down = string(raw)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+type Migrator struct {
+	pool       *pgxpool.Pool
+	lgr        *zap.Logger
+	migrations []Migration
+}
+
+func NewMigrator(pool *pgxpool.Pool, lgr *zap.Logger) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, lgr: lgr, migrations: migrations}, nil
+}
+
+// Applies every migration newer than the current version. Returns how many were applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+	err := m.withLock(ctx, func(conn *pgxpool.Conn, current int) error {
+		current, err := m.baseline(ctx, conn, current)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if mig.Version <= current {
+				continue
+			}
+			m.lgr.Info("applying migration", zap.Int("version", mig.Version), zap.String("name", mig.Name))
+			if err := m.apply(ctx, conn, mig.Up,
+				"INSERT INTO schema_migrations(version, name) VALUES($1, $2)", mig.Version, mig.Name,
+			); err != nil {
+				return fmt.Errorf("error applying migration %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Rolls back the newest `steps` applied migrations. Returns how many were rolled back.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	rolledBack := 0
+	err := m.withLock(ctx, func(conn *pgxpool.Conn, current int) error {
+		for i := len(m.migrations) - 1; i >= 0 && rolledBack < steps; i-- {
+			mig := m.migrations[i]
+			if mig.Version > current {
+				continue
+			}
+			m.lgr.Info("rolling back migration", zap.Int("version", mig.Version), zap.String("name", mig.Name))
+			if err := m.apply(ctx, conn, mig.Down,
+				"DELETE FROM schema_migrations WHERE version = $1", mig.Version,
+			); err != nil {
+				return fmt.Errorf("error rolling back migration %04d_%s: %w", mig.Version, mig.Name, err)
+			}
+			rolledBack++
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// Newest applied migration. 0 if none. Read only, so doesn't create schema_migrations or take the lock
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	var exists bool
+	if err := m.pool.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	err := m.pool.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Databases set up from the old create_tables.sql already have 0001's tables but no schema_migrations rows.
+// Marks 0001 as applied for those rather than failing on CREATE TABLE appusers. Returns the new current version.
+func (m *Migrator) baseline(ctx context.Context, conn *pgxpool.Conn, current int) (int, error) {
+	if current > 0 || len(m.migrations) == 0 || m.migrations[0].Version != 1 {
+		return current, nil
+	}
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT to_regclass('appusers') IS NOT NULL").Scan(&exists); err != nil {
+		return current, err
+	}
+	if !exists {
+		return current, nil
+	}
+	first := m.migrations[0]
+	m.lgr.Info("found tables from create_tables.sql, marking migration as already applied",
+		zap.Int("version", first.Version), zap.String("name", first.Name))
+	if _, err := conn.Exec(ctx,
+		"INSERT INTO schema_migrations(version, name) VALUES($1, $2)", first.Version, first.Name,
+	); err != nil {
+		return current, err
+	}
+	return first.Version, nil
+}
+
+// Fails if any of RequiredExtensions isn't installed, with a hint about how to fix it.
+func (m *Migrator) CheckExtensions(ctx context.Context) error {
+	rows, err := m.pool.Query(ctx, "SELECT extname FROM pg_extension")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	installed := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		installed[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	missing := make([]string, 0)
+	for _, ext := range RequiredExtensions {
+		if !installed[ext] {
+			missing = append(missing, ext)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf(
+			"missing postgres extensions: %s. as the postgres superuser run `CREATE EXTENSION IF NOT EXISTS <name>;` for each",
+			strings.Join(missing, ", "),
+		)
+	}
+	return nil
+}
+
+// Runs f holding the migration advisory lock on a single connection, with schema_migrations created
+// and the current version read.
+func (m *Migrator) withLock(ctx context.Context, f func(conn *pgxpool.Conn, current int) error) error {
+	if err := m.CheckExtensions(ctx); err != nil {
+		return err
+	}
+	// advisory locks belong to a session, so everything has to happen on the same connection
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", advisoryLockId); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", advisoryLockId)
+
+	if _, err := conn.Exec(ctx,
+		"CREATE TABLE IF NOT EXISTS schema_migrations("+
+			"version INTEGER PRIMARY KEY, "+
+			"name TEXT NOT NULL, "+
+			"applied_at TIMESTAMPTZ NOT NULL DEFAULT now())",
+	); err != nil {
+		return err
+	}
+	var current int
+	if err := conn.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+	return f(conn, current)
+}
+
+// Runs a migration's SQL and the schema_migrations bookkeeping in one transaction,
+// so a failed migration leaves nothing half-done.
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, migrationSql, bookkeepingSql string, args ...interface{}) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	// no args, so this goes over the simple protocol and files can hold several statements
+	if _, err := tx.Exec(ctx, migrationSql); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, bookkeepingSql, args...); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
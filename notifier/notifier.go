@@ -0,0 +1,138 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	KindFCM    = "fcm"
+	KindLog    = "log"
+	KindMemory = "memory"
+)
+
+// Notifier.Send errors wrap these when retrying won't help. Anything else is assumed to be worth another go.
+var (
+	// the device token is dead (app uninstalled, token rotated...). the outbox stops sending to it
+	ErrInvalidToken = errors.New("device token is no longer valid")
+	// e.g. our credentials are wrong
+	ErrPermanent = errors.New("permanent notification failure")
+)
+
+// What gets pushed to a device. The phone shows Title/Body itself, so they appear even when the app isn't running.
+// Data is for the app to act on once it's opened.
+type Message struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Data  map[string]string `json:"data"`
+}
+
+// Anything that can push a message to a device. fcm_client.FCMController is the real one,
+// the others are for running the server without firebase credentials (CI, laptops etc).
+type Notifier interface {
+	// should give up when ctx is done, so a hung send can't hold up a worker or shutdown
+	Send(ctx context.Context, toToken string, msg Message) error
+	// one of the Kind* consts, so /health/ready can say whether notifications are really going out
+	Kind() string
+}
+
+// Notifiers that can send the same message to lots of devices in one call. The outbox uses it when it's there.
+type MulticastNotifier interface {
+	Notifier
+	// One error per token in the same order, nil where it went through
+	SendMulticast(ctx context.Context, toTokens []string, msg Message) []error
+}
+
+// Just logs what would have been sent.
+type LogNotifier struct {
+	Lgr *zap.Logger
+}
+
+func NewLogNotifier(lgr *zap.Logger) *LogNotifier {
+	return &LogNotifier{Lgr: lgr}
+}
+
+func (n *LogNotifier) Send(ctx context.Context, toToken string, msg Message) error {
+	n.Lgr.Info("not sending notification (log notifier)",
+		zap.String("To", toToken), zap.String("title", msg.Title), zap.String("body", msg.Body), zap.Any("data", msg.Data),
+	)
+	return nil
+}
+
+func (n *LogNotifier) Kind() string {
+	return KindLog
+}
+
+type Notification struct {
+	Token string `json:"token"`
+	Message
+}
+
+// Keeps everything it's asked to send in memory so the offer/response flow can be checked without a phone.
+// Send fails with FailWith if it's set.
+type RecordingNotifier struct {
+	mu       sync.Mutex
+	sent     []Notification
+	FailWith error
+}
+
+func NewRecordingNotifier() *RecordingNotifier {
+	return &RecordingNotifier{}
+}
+
+func (n *RecordingNotifier) Send(ctx context.Context, toToken string, msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.FailWith != nil {
+		return n.FailWith
+	}
+	// copy so callers re-using their map don't rewrite history
+	dataCopy := make(map[string]string, len(msg.Data))
+	for k, v := range msg.Data {
+		dataCopy[k] = v
+	}
+	msg.Data = dataCopy
+	n.sent = append(n.sent, Notification{Token: toToken, Message: msg})
+	return nil
+}
+
+// Just Send for each token, but means the outbox's multicast path can be run without FCM
+func (n *RecordingNotifier) SendMulticast(ctx context.Context, toTokens []string, msg Message) []error {
+	errs := make([]error, len(toTokens))
+	for i, token := range toTokens {
+		errs[i] = n.Send(ctx, token, msg)
+	}
+	return errs
+}
+
+func (n *RecordingNotifier) Kind() string {
+	return KindMemory
+}
+
+func (n *RecordingNotifier) Sent() []Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	sent := make([]Notification, len(n.sent))
+	copy(sent, n.sent)
+	return sent
+}
+
+// Sent to a particular device token
+func (n *RecordingNotifier) SentTo(toToken string) []Notification {
+	sent := make([]Notification, 0)
+	for _, notification := range n.Sent() {
+		if notification.Token == toToken {
+			sent = append(sent, notification)
+		}
+	}
+	return sent
+}
+
+func (n *RecordingNotifier) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = nil
+}
@@ -0,0 +1,50 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRecordingNotifier(t *testing.T) {
+	n := NewRecordingNotifier()
+	data := map[string]string{"type": "offer", "kettleName": "office"}
+	if err := n.Send(context.Background(), "phone-a", Message{Title: "Fancy a brew?", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	data["kettleName"] = "kitchen"
+	if err := n.Send(context.Background(), "phone-b", Message{Title: "Fancy a brew?", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := n.Sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(sent))
+	}
+	if got := sent[0].Data["kettleName"]; got != "office" {
+		t.Errorf("re-using the data map shouldn't change what was recorded, got %q", got)
+	}
+	if toA := n.SentTo("phone-a"); len(toA) != 1 || toA[0].Token != "phone-a" {
+		t.Errorf("expected 1 notification to phone-a, got %+v", toA)
+	}
+	if toC := n.SentTo("phone-c"); len(toC) != 0 {
+		t.Errorf("expected nothing sent to phone-c, got %+v", toC)
+	}
+
+	n.Reset()
+	if sent := n.Sent(); len(sent) != 0 {
+		t.Errorf("expected nothing after Reset, got %+v", sent)
+	}
+}
+
+func TestRecordingNotifierFailWith(t *testing.T) {
+	n := NewRecordingNotifier()
+	boom := errors.New("boom")
+	n.FailWith = boom
+	if err := n.Send(context.Background(), "phone-a", Message{Data: map[string]string{"type": "offer"}}); !errors.Is(err, boom) {
+		t.Fatalf("expected FailWith error, got %v", err)
+	}
+	if sent := n.Sent(); len(sent) != 0 {
+		t.Errorf("failed sends shouldn't be recorded, got %+v", sent)
+	}
+}
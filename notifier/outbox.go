@@ -0,0 +1,302 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+)
+
+const (
+	DefaultOutboxWorkers      = 8
+	DefaultOutboxBatchSize    = 500
+	DefaultMaxAttempts        = 5
+	DefaultRetryBackoff       = 5 * time.Second
+	DefaultMaxRetryBackoff    = 10 * time.Minute
+	DefaultOutboxPollInterval = 5 * time.Second
+	DefaultSendTimeout        = 10 * time.Second
+)
+
+// how long a claimed notification is left alone before someone else can have a go at it. it's taken once when
+// the batch is claimed and again right before each send, so it only has to outlast one send (i.e. SendTimeout)
+// rather than the whole batch
+const sendLease = time.Minute
+
+// served on /debug/vars
+var (
+	sentCount    = expvar.NewInt("notifications_sent")
+	retriedCount = expvar.NewInt("notifications_retried")
+	// gave up on, whether from running out of attempts or the token being dead
+	failedCount = expvar.NewInt("notifications_failed")
+	// firebase tokens marked invalid because FCM said they're dead
+	prunedTokenCount = expvar.NewInt("notifier_pruned_tokens")
+)
+
+// Durable queue in front of a Notifier. Handlers Enqueue and carry on, the workers started by Run do the actual
+// sending concurrently, retry failures with exponential backoff and record what happened to each recipient.
+// Anything still queued when the server stops is picked up again on the next start.
+type Outbox struct {
+	store  storage.Store
+	sender Notifier
+	lgr    *zap.Logger
+	// how many sends can be in flight at once
+	Workers int
+	// how many notifications are claimed at a time. if the sender can multicast, ones in the same batch with the
+	// same message (e.g. everyone told about one offer) go out in a single call
+	BatchSize   int
+	MaxAttempts int
+	// wait before the first retry. doubles for each retry after, up to MaxRetryBackoff
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// how often to look for due retries. new notifications don't wait for this, Enqueue wakes the workers up
+	PollInterval time.Duration
+	// how long each send (or multicast) gets before it's given up on and retried later
+	SendTimeout time.Duration
+	wake        chan struct{}
+}
+
+func NewOutbox(lgr *zap.Logger, store storage.Store, sender Notifier) *Outbox {
+	return &Outbox{
+		store:           store,
+		sender:          sender,
+		lgr:             lgr,
+		Workers:         DefaultOutboxWorkers,
+		BatchSize:       DefaultOutboxBatchSize,
+		MaxAttempts:     DefaultMaxAttempts,
+		RetryBackoff:    DefaultRetryBackoff,
+		MaxRetryBackoff: DefaultMaxRetryBackoff,
+		PollInterval:    DefaultOutboxPollInterval,
+		SendTimeout:     DefaultSendTimeout,
+		wake:            make(chan struct{}, 1),
+	}
+}
+
+// Queues the payload for every device each recipient has and returns straight away.
+// Returns how many of the recipients had at least one device to send to.
+func (o *Outbox) Enqueue(ctx context.Context, recipients []storage.User, payload Payload) (int, error) {
+	if len(recipients) == 0 {
+		return 0, nil
+	}
+	userIds := make([]uuid.UUID, 0, len(recipients))
+	for _, user := range recipients {
+		userIds = append(userIds, user.UserId)
+	}
+	devices, err := o.store.GetNotifiableDevices(ctx, userIds)
+	if err != nil {
+		return 0, err
+	}
+	if len(devices) == 0 {
+		return 0, nil
+	}
+	msg := payload.Message()
+	ns := make([]storage.OutboxNotification, 0, len(devices))
+	reached := make(map[uuid.UUID]bool, len(recipients))
+	for _, device := range devices {
+		ns = append(ns, storage.OutboxNotification{
+			UserId: device.UserId, Token: device.FirebaseToken, Title: msg.Title, Body: msg.Body, Data: msg.Data,
+		})
+		reached[device.UserId] = true
+	}
+	if err := o.store.EnqueueNotifications(ctx, ns); err != nil {
+		return 0, err
+	}
+	// don't block if the workers already know there's work
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return len(reached), nil
+}
+
+// Sends queued notifications until ctx is cancelled. Anything already claimed is sent before it returns.
+func (o *Outbox) Run(ctx context.Context) {
+	// each job is a group of notifications with the same message, so a multicast sender can do it in one call
+	jobs := make(chan []storage.OutboxNotification)
+	var wg sync.WaitGroup
+	for i := 0; i < o.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range jobs {
+				o.send(ctx, group)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+
+	ticker := time.NewTicker(o.PollInterval)
+	defer ticker.Stop()
+	for {
+		// a full batch probably means there's more waiting, so go straight round again
+		if o.dispatch(ctx, jobs) {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Claims a batch of due notifications and hands them to the workers. Returns whether the batch was full.
+func (o *Outbox) dispatch(ctx context.Context, jobs chan<- []storage.OutboxNotification) bool {
+	ns, err := o.store.ClaimDueNotifications(ctx, o.BatchSize, sendLease)
+	if err != nil {
+		if ctx.Err() == nil {
+			o.lgr.Error("error claiming notifications", zap.Error(err))
+		}
+		return false
+	}
+	for _, group := range o.group(ns) {
+		jobs <- group
+	}
+	return len(ns) == o.BatchSize
+}
+
+// Splits ns up into jobs. If the sender can multicast, notifications with the same message are kept together,
+// otherwise every notification is a job of its own so they're spread over the workers.
+func (o *Outbox) group(ns []storage.OutboxNotification) [][]storage.OutboxNotification {
+	groups := make([][]storage.OutboxNotification, 0)
+	if _, ok := o.sender.(MulticastNotifier); !ok {
+		for _, n := range ns {
+			groups = append(groups, []storage.OutboxNotification{n})
+		}
+		return groups
+	}
+	byMessage := make(map[string]int)
+	for _, n := range ns {
+		// json sorts map keys, so equal messages give equal keys
+		key, _ := json.Marshal(message(n))
+		i, ok := byMessage[string(key)]
+		if !ok {
+			i = len(groups)
+			byMessage[string(key)] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], n)
+	}
+	return groups
+}
+
+// Sends are cut short when ctx is done (i.e. we're shutting down), anything that doesn't make it is retried
+// on the next start.
+func (o *Outbox) send(ctx context.Context, group []storage.OutboxNotification) {
+	// the group may have been waiting for a worker for longer than the lease it was claimed with, and been claimed
+	// again since. only send what's still ours
+	group, err := o.store.RenewNotificationLease(context.Background(), group, sendLease)
+	if err != nil {
+		// left for whoever claims them once the lease runs out
+		o.lgr.Error("error renewing notification lease", zap.Error(err))
+		return
+	}
+	if len(group) == 0 {
+		return
+	}
+	multicaster, ok := o.sender.(MulticastNotifier)
+	if !ok || len(group) == 1 {
+		for _, n := range group {
+			sendCtx, cancel := context.WithTimeout(ctx, o.SendTimeout)
+			err := o.sender.Send(sendCtx, n.Token, message(n))
+			cancel()
+			o.record(n, err)
+		}
+		return
+	}
+	tokens := make([]string, len(group))
+	for i, n := range group {
+		tokens[i] = n.Token
+	}
+	sendCtx, cancel := context.WithTimeout(ctx, o.SendTimeout)
+	errs := multicaster.SendMulticast(sendCtx, tokens, message(group[0]))
+	cancel()
+	for i, n := range group {
+		o.record(n, errs[i])
+	}
+}
+
+func message(n storage.OutboxNotification) Message {
+	return Message{Title: n.Title, Body: n.Body, Data: n.Data}
+}
+
+// Saves how the send went: sent, retry later, or give up (pruning the token if it's dead)
+func (o *Outbox) record(n storage.OutboxNotification, err error) {
+	// the claim is already made, so see it through even if we're shutting down
+	ctx := context.Background()
+	if err == nil {
+		sentCount.Add(1)
+		if err := o.store.MarkNotificationSent(ctx, n.NotificationId); err != nil {
+			o.lgr.Error("error marking notification sent", zap.String("notificationId", n.NotificationId.String()), zap.Error(err))
+		}
+		return
+	}
+
+	var retryAt *time.Time
+	switch {
+	case errors.Is(err, ErrInvalidToken):
+		o.pruneToken(ctx, n)
+	case errors.Is(err, ErrPermanent):
+		o.lgr.Error("error sending notification, not retrying",
+			zap.String("notificationId", n.NotificationId.String()), zap.String("userId", n.UserId.String()), zap.Error(err),
+		)
+	case n.Attempts < o.MaxAttempts:
+		at := time.Now().UTC().Add(o.backoff(n.Attempts))
+		retryAt = &at
+		o.lgr.Warn("error sending notification, will retry",
+			zap.String("notificationId", n.NotificationId.String()), zap.String("userId", n.UserId.String()),
+			zap.Int("attempts", n.Attempts), zap.Time("retryAt", at), zap.Error(err),
+		)
+	default:
+		o.lgr.Error("error sending notification, giving up",
+			zap.String("notificationId", n.NotificationId.String()), zap.String("userId", n.UserId.String()),
+			zap.Int("attempts", n.Attempts), zap.Error(err),
+		)
+	}
+	if retryAt == nil {
+		failedCount.Add(1)
+	} else {
+		retriedCount.Add(1)
+	}
+	if err := o.store.MarkNotificationFailed(ctx, n.NotificationId, err.Error(), retryAt); err != nil {
+		o.lgr.Error("error marking notification failed", zap.String("notificationId", n.NotificationId.String()), zap.Error(err))
+	}
+}
+
+// FCM says the device is gone, so stop offering it drinks
+func (o *Outbox) pruneToken(ctx context.Context, n storage.OutboxNotification) {
+	pruned, err := o.store.InvalidateFirebaseToken(ctx, n.Token)
+	if err != nil {
+		o.lgr.Error("error invalidating firebase token", zap.String("userId", n.UserId.String()), zap.Error(err))
+		return
+	}
+	// already pruned by another send to the same token
+	if !pruned {
+		return
+	}
+	prunedTokenCount.Add(1)
+	o.lgr.Info("pruned dead firebase token", zap.String("userId", n.UserId.String()), zap.Int64("prunedTotal", prunedTokenCount.Value()))
+}
+
+// RetryBackoff doubled for every attempt after the first, capped at MaxRetryBackoff
+func (o *Outbox) backoff(attempts int) time.Duration {
+	wait := o.RetryBackoff
+	for i := 1; i < attempts && wait < o.MaxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > o.MaxRetryBackoff {
+		wait = o.MaxRetryBackoff
+	}
+	return wait
+}
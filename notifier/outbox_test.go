@@ -0,0 +1,65 @@
+package notifier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+)
+
+// Never gets through, just waits to be given up on
+type hungNotifier struct {
+	gaveUp chan error
+}
+
+func (n *hungNotifier) Send(ctx context.Context, toToken string, msg Message) error {
+	<-ctx.Done()
+	n.gaveUp <- ctx.Err()
+	return ctx.Err()
+}
+
+func (n *hungNotifier) Kind() string {
+	return KindMemory
+}
+
+func TestOutboxSendTimeout(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	u := storage.User{DefaultNickname: "alice", TheUsual: "tea"}
+	if _, err := store.UpsertUser(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RegisterDevice(ctx, &storage.Device{UserId: u.UserId, FirebaseToken: "phone-a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &hungNotifier{gaveUp: make(chan error, 1)}
+	o := NewOutbox(zap.NewNop(), store, sender)
+	o.SendTimeout = 10 * time.Millisecond
+	o.MaxAttempts = 1
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		o.Run(runCtx)
+		close(done)
+	}()
+	defer func() {
+		stop()
+		<-done
+	}()
+
+	if _, err := o.Enqueue(ctx, []storage.User{u}, RoundExpiredPayload{KettleName: "office"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-sender.gaveUp:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected the send to time out, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("hung send was never given up on")
+	}
+}
@@ -0,0 +1,297 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+)
+
+// values of Data["type"], so the app knows what it's been sent
+const (
+	TypeOffer          = "offer"
+	TypeDrinkRequest   = "drinkrequest"
+	TypeRoundFinished  = "roundfinished"
+	TypeRoundExpired   = "roundexpired"
+	TypeRoundTakenOver = "roundtakenover"
+	TypeReminder       = "reminder"
+	TypeNudge          = "nudge"
+	TypeSignIn         = "signin"
+)
+
+// Something that can be turned into a notification. Everything in the Data is filled in server-side,
+// so the app never has to take another client's word for who someone is.
+type Payload interface {
+	Message() Message
+}
+
+// Someone's putting the kettle on. Sent to everyone who might want a drink.
+type OfferPayload struct {
+	KettleId      uuid.UUID
+	KettleName    string
+	RoundId       uuid.UUID
+	MakerId       uuid.UUID
+	MakerNickname string
+	// orders need to be in before the round expires
+	Deadline time.Time
+	// empty if the kettle hasn't set one
+	Menu storage.Menu
+}
+
+// out of stock items named in an offer's body. any more and it just says how many others
+const offerOutOfStockShown = 3
+
+func (p OfferPayload) Message() Message {
+	body := fmt.Sprintf("Fancy a brew from %s? Get your order in within %s", p.KettleName, minutesUntil(p.Deadline))
+	if out := p.Menu.OutOfStock(); len(out) > offerOutOfStockShown {
+		body += fmt.Sprintf(". Out of %s and %d more", strings.Join(out[:offerOutOfStockShown], ", "), len(out)-offerOutOfStockShown)
+	} else if len(out) > 0 {
+		body += fmt.Sprintf(". Out of %s", strings.Join(out, ", "))
+	}
+	msg := Message{
+		Title: fmt.Sprintf("%s is putting the kettle on", p.MakerNickname),
+		Body:  body,
+		Data: map[string]string{
+			"type":          TypeOffer,
+			"kettleId":      p.KettleId.String(),
+			"kettleName":    p.KettleName,
+			"roundId":       p.RoundId.String(),
+			"makerId":       p.MakerId.String(),
+			"makerNickname": p.MakerNickname,
+			"deadline":      p.Deadline.UTC().Format(time.RFC3339),
+		},
+	}
+	// FCM data has to stay under 4KB, so rather than sending the menu the app fetches it with
+	// GET /kettles/{kettleId}/menu/
+	if len(p.Menu) > 0 {
+		msg.Data["hasMenu"] = "true"
+	}
+	return msg
+}
+
+// Someone wants a drink. Sent to the maker.
+type DrinkRequestPayload struct {
+	KettleId          uuid.UUID
+	RoundId           uuid.UUID
+	RequestId         uuid.UUID
+	RequesterId       uuid.UUID
+	RequesterNickname string
+	Choice            string
+	// nil for free text orders
+	Order *storage.DrinkOrder
+	// run out items a free text order looks like it asks for, so the maker can check with them
+	Unavailable []string
+}
+
+func (p DrinkRequestPayload) Message() Message {
+	msg := Message{
+		Title: fmt.Sprintf("%s wants a drink", p.RequesterNickname),
+		Body:  p.Choice,
+		Data: map[string]string{
+			"type":              TypeDrinkRequest,
+			"kettleId":          p.KettleId.String(),
+			"roundId":           p.RoundId.String(),
+			"requestId":         p.RequestId.String(),
+			"requesterId":       p.RequesterId.String(),
+			"requesterNickname": p.RequesterNickname,
+			// "name" is what older versions of the app read
+			"name":   p.RequesterNickname,
+			"choice": p.Choice,
+		},
+	}
+	if len(p.Unavailable) > 0 {
+		msg.Body += fmt.Sprintf(" (but we're out of %s)", strings.Join(p.Unavailable, ", "))
+		msg.Data["unavailable"] = strings.Join(p.Unavailable, ",")
+	}
+	if p.Order != nil {
+		// data values have to be strings, so the app parses this itself
+		order, _ := json.Marshal(p.Order)
+		msg.Data["order"] = string(order)
+	}
+	return msg
+}
+
+// The round's finished. Each drinker gets their own, saying whether their drink actually got made.
+type RoundFinishedPayload struct {
+	KettleId      uuid.UUID
+	KettleName    string
+	RoundId       uuid.UUID
+	MakerId       uuid.UUID
+	MakerNickname string
+	// what they ordered
+	Choice string
+	// false if the maker ticked off other drinks but not this one
+	Made bool
+	// where to pick it up, e.g. "the kitchen counter". optional
+	CollectFrom string
+}
+
+func (p RoundFinishedPayload) Message() Message {
+	title := fmt.Sprintf("Your %s is ready", p.Choice)
+	body := fmt.Sprintf("%s has made a round at %s", p.MakerNickname, p.KettleName)
+	if !p.Made {
+		title = "No drink this time"
+		body = fmt.Sprintf("%s couldn't make your %s at %s", p.MakerNickname, p.Choice, p.KettleName)
+	} else if p.CollectFrom != "" {
+		body += ". Collect from " + p.CollectFrom
+	}
+	return Message{
+		Title: title,
+		Body:  body,
+		Data: map[string]string{
+			"type":          TypeRoundFinished,
+			"kettleId":      p.KettleId.String(),
+			"kettleName":    p.KettleName,
+			"roundId":       p.RoundId.String(),
+			"makerId":       p.MakerId.String(),
+			"makerNickname": p.MakerNickname,
+			"choice":        p.Choice,
+			"made":          strconv.FormatBool(p.Made),
+			"collectFrom":   p.CollectFrom,
+		},
+	}
+}
+
+// The maker never finished the round, so it's been given up on. Sent to everyone who ordered.
+type RoundExpiredPayload struct {
+	KettleId      uuid.UUID
+	KettleName    string
+	RoundId       uuid.UUID
+	MakerId       uuid.UUID
+	MakerNickname string
+}
+
+func (p RoundExpiredPayload) Message() Message {
+	return Message{
+		Title: "No drink this time",
+		Body:  fmt.Sprintf("%s's round at %s was abandoned", p.MakerNickname, p.KettleName),
+		Data: map[string]string{
+			"type":          TypeRoundExpired,
+			"kettleId":      p.KettleId.String(),
+			"kettleName":    p.KettleName,
+			"roundId":       p.RoundId.String(),
+			"makerId":       p.MakerId.String(),
+			"makerNickname": p.MakerNickname,
+		},
+	}
+}
+
+// Someone else took over the maker's round, so it's been cancelled. Sent to the old maker and everyone who ordered,
+// they'll need to order again from the new round.
+type RoundTakenOverPayload struct {
+	KettleId         uuid.UUID
+	KettleName       string
+	RoundId          uuid.UUID
+	MakerId          uuid.UUID
+	MakerNickname    string
+	NewRoundId       uuid.UUID
+	NewMakerId       uuid.UUID
+	NewMakerNickname string
+}
+
+func (p RoundTakenOverPayload) Message() Message {
+	return Message{
+		Title: "Change of plan",
+		Body:  fmt.Sprintf("%s has taken over %s's round at %s. Order again if you still want a drink", p.NewMakerNickname, p.MakerNickname, p.KettleName),
+		Data: map[string]string{
+			"type":             TypeRoundTakenOver,
+			"kettleId":         p.KettleId.String(),
+			"kettleName":       p.KettleName,
+			"roundId":          p.RoundId.String(),
+			"makerId":          p.MakerId.String(),
+			"makerNickname":    p.MakerNickname,
+			"newRoundId":       p.NewRoundId.String(),
+			"newMakerId":       p.NewMakerId.String(),
+			"newMakerNickname": p.NewMakerNickname,
+		},
+	}
+}
+
+// The maker's round is about to expire. Sent to the maker.
+type ReminderPayload struct {
+	KettleId   uuid.UUID
+	KettleName string
+	RoundId    uuid.UUID
+	// when the round will be expired if it's not finished
+	Deadline time.Time
+}
+
+func (p ReminderPayload) Message() Message {
+	return Message{
+		Title: "Where's the tea?",
+		// no "in N minutes", a retry could go out well after this is built. the app can count down to deadline
+		Body: fmt.Sprintf("Your round at %s is about to expire. Finish it or people will go thirsty", p.KettleName),
+		Data: map[string]string{
+			"type":       TypeReminder,
+			"kettleId":   p.KettleId.String(),
+			"kettleName": p.KettleName,
+			"roundId":    p.RoundId.String(),
+			"deadline":   p.Deadline.UTC().Format(time.RFC3339),
+		},
+	}
+}
+
+// Someone's after a drink but nobody's making. Sent to whoever's turn it is on the kettle's rota.
+type NudgePayload struct {
+	KettleId          uuid.UUID
+	KettleName        string
+	RequesterId       uuid.UUID
+	RequesterNickname string
+	// how many more cups they've had than they've made. 0 if they're not in debt, it's just their turn
+	CupsOwed int
+}
+
+func (p NudgePayload) Message() Message {
+	body := fmt.Sprintf("%s is after a brew at %s and you're next on the rota", p.RequesterNickname, p.KettleName)
+	if p.CupsOwed == 1 {
+		body += " (you're a cup behind)"
+	} else if p.CupsOwed > 1 {
+		body += fmt.Sprintf(" (you're %d cups behind)", p.CupsOwed)
+	}
+	return Message{
+		Title: "Fancy putting the kettle on?",
+		Body:  body,
+		Data: map[string]string{
+			"type":              TypeNudge,
+			"kettleId":          p.KettleId.String(),
+			"kettleName":        p.KettleName,
+			"requesterId":       p.RequesterId.String(),
+			"requesterNickname": p.RequesterNickname,
+			"cupsOwed":          strconv.Itoa(p.CupsOwed),
+		},
+	}
+}
+
+// Someone asked for a new session for this user. The app posts the code to /sessions/ to get one,
+// which proves it's really one of their devices. Sent to all the user's devices.
+type SignInPayload struct {
+	Code      string
+	ExpiresAt time.Time
+}
+
+func (p SignInPayload) Message() Message {
+	return Message{
+		Title: "Signing you back in",
+		Body:  "If that wasn't you, you can ignore this",
+		Data: map[string]string{
+			"type":      TypeSignIn,
+			"code":      p.Code,
+			"expiresAt": p.ExpiresAt.UTC().Format(time.RFC3339),
+		},
+	}
+}
+
+// "5 minutes". the server's clock/timezone aren't the phone's, so the text says how long rather than what time
+// (the exact deadline is in the data for the app)
+func minutesUntil(deadline time.Time) string {
+	minutes := int(time.Until(deadline).Round(time.Minute).Minutes())
+	if minutes <= 1 {
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
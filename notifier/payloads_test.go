@@ -0,0 +1,52 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ThePianoDentist/fancy-a-brew/storage"
+)
+
+func TestOfferPayloadFitsInFCM(t *testing.T) {
+	menu := make(storage.Menu, 0)
+	for i := 0; i < 200; i++ {
+		menu = append(menu, storage.MenuItem{Kind: storage.MenuDrink, Item: fmt.Sprintf("some very fancy loose leaf tea number %d", i), InStock: i%2 == 0})
+	}
+	p := OfferPayload{
+		KettleId: uuid.New(), KettleName: "office", RoundId: uuid.New(), MakerId: uuid.New(), MakerNickname: "alice",
+		Deadline: time.Now().Add(15 * time.Minute), Menu: menu,
+	}
+	msg := p.Message()
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// FCM's limit is 4KB, leave plenty of room for long kettle names etc
+	if len(raw) > 1024 {
+		t.Errorf("offer is %d bytes: %s", len(raw), raw)
+	}
+	if msg.Data["hasMenu"] != "true" {
+		t.Errorf("offer should say the kettle has a menu, got %+v", msg.Data)
+	}
+	if !strings.Contains(msg.Body, "and 97 more") {
+		t.Errorf("offer should only name a few out of stock items, got %q", msg.Body)
+	}
+}
+
+// reminders can be retried minutes after they're queued, so nothing in them should be relative to now
+func TestReminderPayloadDoesntGoStale(t *testing.T) {
+	deadline := time.Date(2021, 3, 4, 10, 30, 0, 0, time.UTC)
+	p := ReminderPayload{KettleId: uuid.New(), KettleName: "office", RoundId: uuid.New(), Deadline: deadline}
+	msg := p.Message()
+	if strings.Contains(msg.Body, "minute") {
+		t.Errorf("body shouldn't count down, got %q", msg.Body)
+	}
+	if msg.Data["deadline"] != "2021-03-04T10:30:00Z" {
+		t.Errorf("expected the deadline in the data, got %+v", msg.Data)
+	}
+}
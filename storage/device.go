@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+// Returned by RegisterDevice when the token belongs to somebody else. They have to remove it before anyone
+// else can have it, otherwise knowing a token would be enough to steal someone's notifications.
+var ErrDeviceTaken = errors.New("device is registered to another user")
+
+// Somewhere a user's notifications go. A user can have as many as they like (phone, tablet...)
+type Device struct {
+	DeviceId      uuid.UUID `json:"deviceId"`
+	UserId        uuid.UUID `json:"userId"`
+	FirebaseToken string    `json:"-"`
+	Name          string    `json:"name"`
+	RegisteredAt  time.Time `json:"registeredAt"`
+	// when FCM said the token was dead. nil if it's fine
+	InvalidSince *time.Time `json:"invalidSince"`
+}
+
+const deviceColumns = "device_id, user_id, firebase_token, name, registered_at, invalid_since"
+
+func (d *Device) scanFields() []interface{} {
+	return []interface{}{&d.DeviceId, &d.UserId, &d.FirebaseToken, &d.Name, &d.RegisteredAt, &d.InvalidSince}
+}
+
+// Adds the token as one of d.UserId's devices. If they've already got it, it counts as valid again (and is renamed
+// if d.Name is set). ErrDeviceTaken if it's someone else's. Fills in the rest of d.
+func (s *PostgresStore) RegisterDevice(ctx context.Context, d *Device) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err := s.pool.QueryRow(ctx,
+		"INSERT INTO user_devices(user_id, firebase_token, name) VALUES($1, $2, $3) "+
+			"ON CONFLICT(firebase_token) DO UPDATE "+
+			"SET name=COALESCE(NULLIF(EXCLUDED.name,''), user_devices.name), invalid_since=NULL "+
+			// nothing comes back if it's someone else's
+			"WHERE user_devices.user_id = EXCLUDED.user_id "+
+			"RETURNING "+deviceColumns,
+		d.UserId, d.FirebaseToken, d.Name,
+	).Scan(d.scanFields()...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrDeviceTaken
+	}
+	return err
+}
+
+// Returns false if the user has no such device
+func (s *PostgresStore) RemoveDevice(ctx context.Context, userId, deviceId uuid.UUID) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, "DELETE FROM user_devices WHERE user_id = $1 AND device_id = $2", userId, deviceId)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) GetUserDevices(ctx context.Context, userId uuid.UUID) ([]Device, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.queryDevices(ctx, "SELECT "+deviceColumns+" FROM user_devices WHERE user_id = $1 ORDER BY registered_at", userId)
+}
+
+// Every device that should get a notification meant for these users, i.e. leaving out dead tokens
+func (s *PostgresStore) GetNotifiableDevices(ctx context.Context, userIds []uuid.UUID) ([]Device, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	ids := make([]string, len(userIds))
+	for i, id := range userIds {
+		ids[i] = id.String()
+	}
+	return s.queryDevices(ctx,
+		"SELECT "+deviceColumns+" FROM user_devices WHERE user_id = ANY($1::uuid[]) AND invalid_since IS NULL", ids,
+	)
+}
+
+// Marks the token dead so nothing more gets sent to it. Returns false if no device has it or it was already marked.
+func (s *PostgresStore) InvalidateFirebaseToken(ctx context.Context, firebaseToken string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx,
+		"UPDATE user_devices SET invalid_since = now() WHERE firebase_token = $1 AND invalid_since IS NULL",
+		firebaseToken,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) queryDevices(ctx context.Context, query string, args ...interface{}) ([]Device, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]Device, 0)
+
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(d.scanFields()...); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+
+	return devices, rows.Err()
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRegisterDeviceOwnership(t *testing.T) {
+	forEachStore(t, testRegisterDeviceOwnership)
+}
+
+func testRegisterDeviceOwnership(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice, bob := testUser(t, s, "alice"), testUser(t, s, "bob")
+	token := "test-" + uuid.New().String()
+
+	first := Device{UserId: alice.UserId, FirebaseToken: token, Name: "pixel"}
+	if err := s.RegisterDevice(ctx, &first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.InvalidateFirebaseToken(ctx, token); err != nil {
+		t.Fatal(err)
+	}
+	again := Device{UserId: alice.UserId, FirebaseToken: token}
+	if err := s.RegisterDevice(ctx, &again); err != nil {
+		t.Fatal(err)
+	}
+	if again.DeviceId != first.DeviceId || again.Name != "pixel" || again.InvalidSince != nil {
+		t.Errorf("re-registering should revive the same device and keep its name, got %+v", again)
+	}
+
+	stolen := Device{UserId: bob.UserId, FirebaseToken: token}
+	if err := s.RegisterDevice(ctx, &stolen); !errors.Is(err, ErrDeviceTaken) {
+		t.Fatalf("expected ErrDeviceTaken registering alice's token for bob, got %v", err)
+	}
+	owner, err := s.GetUserIdFromToken(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != alice.UserId {
+		t.Errorf("token should still be alice's, got %s", owner)
+	}
+	if removed, err := s.RemoveDevice(ctx, alice.UserId, first.DeviceId); err != nil || !removed {
+		t.Fatalf("expected alice to remove her device, got %v %v", removed, err)
+	}
+	if err := s.RegisterDevice(ctx, &stolen); err != nil {
+		t.Errorf("bob should get the token once alice has let it go, got %v", err)
+	}
+}
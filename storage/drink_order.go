@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+type DrinkType string
+
+const (
+	DrinkTea          DrinkType = "tea"
+	DrinkCoffee       DrinkType = "coffee"
+	DrinkGreenTea     DrinkType = "green_tea"
+	DrinkHerbalTea    DrinkType = "herbal_tea"
+	DrinkHotChocolate DrinkType = "hot_chocolate"
+	DrinkWater        DrinkType = "water"
+)
+
+// e.g. "hot chocolate"
+func (d DrinkType) Label() string {
+	return strings.ReplaceAll(string(d), "_", " ")
+}
+
+// The drink a bit of free text is the name of, e.g. "Hot chocolate". false if it's anything more than just a name
+func ParseDrinkType(text string) (DrinkType, bool) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	for _, d := range drinkTypes {
+		if text == DrinkType(d).Label() {
+			return DrinkType(d), true
+		}
+	}
+	return "", false
+}
+
+var drinkTypes = []string{string(DrinkTea), string(DrinkCoffee), string(DrinkGreenTea), string(DrinkHerbalTea), string(DrinkHotChocolate), string(DrinkWater)}
+
+type Strength string
+
+const (
+	StrengthWeak   Strength = "weak"
+	StrengthNormal Strength = "normal"
+	StrengthStrong Strength = "strong"
+)
+
+var strengths = []string{string(StrengthWeak), string(StrengthNormal), string(StrengthStrong)}
+
+type MilkType string
+
+const (
+	MilkNone   MilkType = "none"
+	MilkCow    MilkType = "cow"
+	MilkOat    MilkType = "oat"
+	MilkSoy    MilkType = "soy"
+	MilkAlmond MilkType = "almond"
+)
+
+var milkTypes = []string{string(MilkNone), string(MilkCow), string(MilkOat), string(MilkSoy), string(MilkAlmond)}
+
+type MilkAmount string
+
+const (
+	MilkSplash MilkAmount = "splash"
+	MilkNormal MilkAmount = "normal"
+	MilkLots   MilkAmount = "lots"
+)
+
+var milkAmounts = []string{string(MilkSplash), string(MilkNormal), string(MilkLots)}
+
+type Temperature string
+
+const (
+	TemperatureHot  Temperature = "hot"
+	TemperatureWarm Temperature = "warm"
+	TemperatureCold Temperature = "cold"
+)
+
+var temperatures = []string{string(TemperatureHot), string(TemperatureWarm), string(TemperatureCold)}
+
+type CupSize string
+
+const (
+	CupSmall   CupSize = "small"
+	CupRegular CupSize = "regular"
+	CupLarge   CupSize = "large"
+)
+
+var cupSizes = []string{string(CupSmall), string(CupRegular), string(CupLarge)}
+
+const (
+	MaxSugars     = 5
+	MaxOrderNotes = 200
+)
+
+// What someone wants, in a form the maker can count up. Only Drink is required, anything left empty means
+// "however you'd normally make it".
+type DrinkOrder struct {
+	Drink       DrinkType   `json:"drink"`
+	Strength    Strength    `json:"strength,omitempty"`
+	Milk        MilkType    `json:"milk,omitempty"`
+	MilkAmount  MilkAmount  `json:"milkAmount,omitempty"`
+	Sugars      int         `json:"sugars"`
+	Sweeteners  int         `json:"sweeteners"`
+	Temperature Temperature `json:"temperature,omitempty"`
+	CupSize     CupSize     `json:"cupSize,omitempty"`
+	// anything that doesn't fit above, e.g. "bag in"
+	Notes string `json:"notes,omitempty"`
+}
+
+// Error messages are meant for showing to whoever sent the order
+func (o DrinkOrder) Validate() error {
+	if o.Drink == "" {
+		return fmt.Errorf("order needs a drink, one of %s", strings.Join(drinkTypes, ", "))
+	}
+	if !oneOf(string(o.Drink), drinkTypes) {
+		return fmt.Errorf("drink must be one of %s", strings.Join(drinkTypes, ", "))
+	}
+	if o.Strength != "" && !oneOf(string(o.Strength), strengths) {
+		return fmt.Errorf("strength must be one of %s", strings.Join(strengths, ", "))
+	}
+	if o.Milk != "" && !oneOf(string(o.Milk), milkTypes) {
+		return fmt.Errorf("milk must be one of %s", strings.Join(milkTypes, ", "))
+	}
+	if o.MilkAmount != "" {
+		if !oneOf(string(o.MilkAmount), milkAmounts) {
+			return fmt.Errorf("milkAmount must be one of %s", strings.Join(milkAmounts, ", "))
+		}
+		if o.Milk == MilkNone {
+			return fmt.Errorf("milkAmount doesn't make sense with no milk")
+		}
+	}
+	if o.Sugars < 0 || o.Sugars > MaxSugars {
+		return fmt.Errorf("sugars must be between 0 and %d", MaxSugars)
+	}
+	if o.Sweeteners < 0 || o.Sweeteners > MaxSugars {
+		return fmt.Errorf("sweeteners must be between 0 and %d", MaxSugars)
+	}
+	if o.Temperature != "" && !oneOf(string(o.Temperature), temperatures) {
+		return fmt.Errorf("temperature must be one of %s", strings.Join(temperatures, ", "))
+	}
+	if o.CupSize != "" && !oneOf(string(o.CupSize), cupSizes) {
+		return fmt.Errorf("cupSize must be one of %s", strings.Join(cupSizes, ", "))
+	}
+	if len(o.Notes) > MaxOrderNotes {
+		return fmt.Errorf("notes can't be longer than %d characters", MaxOrderNotes)
+	}
+	return nil
+}
+
+// Human readable, e.g. "strong tea, oat milk (splash), 1 sugar". This is what gets stored as the plain text choice,
+// so old app versions still have something to show.
+func (o DrinkOrder) String() string {
+	drink := o.Drink.Label()
+	if o.Strength != "" && o.Strength != StrengthNormal {
+		drink = string(o.Strength) + " " + drink
+	}
+	if o.Temperature != "" && o.Temperature != TemperatureHot {
+		drink = string(o.Temperature) + " " + drink
+	}
+	parts := []string{drink}
+	switch o.Milk {
+	case "":
+	case MilkNone:
+		parts = append(parts, "no milk")
+	default:
+		milk := "milk"
+		if o.Milk != MilkCow {
+			milk = string(o.Milk) + " milk"
+		}
+		if o.MilkAmount != "" && o.MilkAmount != MilkNormal {
+			milk += fmt.Sprintf(" (%s)", o.MilkAmount)
+		}
+		parts = append(parts, milk)
+	}
+	if o.Sugars > 0 {
+		parts = append(parts, Plural(o.Sugars, "sugar"))
+	}
+	if o.Sweeteners > 0 {
+		parts = append(parts, Plural(o.Sweeteners, "sweetener"))
+	}
+	if o.CupSize != "" && o.CupSize != CupRegular {
+		parts = append(parts, string(o.CupSize)+" cup")
+	}
+	if o.Notes != "" {
+		parts = append(parts, o.Notes)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// e.g. "1 sugar", "2 sugars". Only for words that just take an s
+func Plural(n int, thing string) string {
+	if n == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
+
+func oneOf(v string, values []string) bool {
+	for _, allowed := range values {
+		if v == allowed {
+			return true
+		}
+	}
+	return false
+}
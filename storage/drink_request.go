@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+type DrinkRequest struct {
+	RequestId uuid.UUID `json:"requestId"`
+	RoundId   uuid.UUID `json:"roundId"`
+	UserId    uuid.UUID `json:"userId"`
+	Nickname  string    `json:"nickname"`
+	// plain text for showing. if Order is set this is Order.String()
+	Choice string `json:"choice"`
+	// nil for free text orders from old app versions
+	Order          *DrinkOrder `json:"order"`
+	TheUsualTicked bool        `json:"theUsualTicked"`
+	RequestedAt    time.Time   `json:"requestedAt"`
+	// when the maker marked it made. nil if they haven't
+	DoneAt *time.Time `json:"doneAt"`
+}
+
+// Stores the drink against the round. If the user already asked for something this round, their order is replaced
+// (and no longer counts as made). ErrRoundClosed if the round isn't offered or collecting.
+func (s *PostgresStore) UpsertDrinkRequest(ctx context.Context, dr *DrinkRequest) (uuid.UUID, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err := s.pool.QueryRow(ctx,
+		"INSERT INTO drink_requests(round_id, user_id, choice, drink_order, the_usual_ticked) "+
+			// nothing is inserted unless the round's still taking orders. FOR SHARE holds off the maker
+			// moving it on until this is in, so it can't miss the brew sheet
+			"SELECT r.round_id, $2::uuid, $3::text, $4::jsonb, $5::boolean FROM drink_rounds r "+
+			"WHERE r.round_id = $1 AND r.state IN ($6, $7) FOR SHARE "+
+			"ON CONFLICT(round_id, user_id) DO UPDATE "+
+			"SET choice=EXCLUDED.choice, drink_order=EXCLUDED.drink_order, the_usual_ticked=EXCLUDED.the_usual_ticked, requested_at=now(), done_at=NULL "+
+			"RETURNING request_id, requested_at, done_at",
+		dr.RoundId, dr.UserId, dr.Choice, dr.Order, dr.TheUsualTicked, RoundOffered, RoundCollecting,
+	).Scan(&dr.RequestId, &dr.RequestedAt, &dr.DoneAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.UUID{}, ErrRoundClosed
+	}
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	return dr.RequestId, nil
+}
+
+func (s *PostgresStore) GetRoundDrinkRequests(ctx context.Context, roundId uuid.UUID) ([]DrinkRequest, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx,
+		"SELECT dr.request_id, dr.round_id, dr.user_id, u.default_nickname, dr.choice, dr.drink_order, dr.the_usual_ticked, dr.requested_at, dr.done_at "+
+			"FROM drink_requests dr JOIN appusers u USING (user_id) "+
+			"WHERE dr.round_id = $1 ORDER BY dr.requested_at", roundId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := make([]DrinkRequest, 0)
+
+	for rows.Next() {
+		var dr DrinkRequest
+		if err := rows.Scan(&dr.RequestId, &dr.RoundId, &dr.UserId, &dr.Nickname, &dr.Choice, &dr.Order, &dr.TheUsualTicked, &dr.RequestedAt, &dr.DoneAt); err != nil {
+			return nil, err
+		}
+		requests = append(requests, dr)
+	}
+
+	return requests, rows.Err()
+}
+
+// Marks the drink as made, or not made if done is false. ErrNotFound if the round has no such request.
+func (s *PostgresStore) SetDrinkRequestDone(ctx context.Context, roundId, requestId uuid.UUID, done bool) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx,
+		"UPDATE drink_requests SET done_at = CASE WHEN $3 THEN COALESCE(done_at, now()) END "+
+			"WHERE round_id = $1 AND request_id = $2",
+		roundId, requestId, done,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUpsertDrinkRequestOnlyWhileTakingOrders(t *testing.T) {
+	forEachStore(t, testUpsertDrinkRequestOnlyWhileTakingOrders)
+}
+
+func testUpsertDrinkRequestOnlyWhileTakingOrders(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice, bob := testUser(t, s, "alice"), testUser(t, s, "bob")
+	k := testKettle(t, s)
+	round, _, err := s.ClaimKettle(ctx, k.KettleId, alice.UserId, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dr := DrinkRequest{RoundId: round.RoundId, UserId: bob.UserId, Choice: "tea"}
+	if _, err := s.UpsertDrinkRequest(ctx, &dr); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []RoundState{RoundCollecting, RoundBrewing} {
+		if err := s.TransitionRound(ctx, &round, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	late := DrinkRequest{RoundId: round.RoundId, UserId: bob.UserId, Choice: "coffee"}
+	if _, err := s.UpsertDrinkRequest(ctx, &late); !errors.Is(err, ErrRoundClosed) {
+		t.Fatalf("expected ErrRoundClosed once the round's brewing, got %v", err)
+	}
+	requests, err := s.GetRoundDrinkRequests(ctx, round.RoundId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Choice != "tea" {
+		t.Errorf("the order should be left as it was, got %+v", requests)
+	}
+}
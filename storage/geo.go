@@ -0,0 +1,17 @@
+package storage
+
+import "math"
+
+// mean earth radius. postgis uses the proper spheroid so it'll disagree by a few metres over long distances,
+// which is plenty good enough for "who's near the kettle"
+const earthRadiusMetres = 6371008.8
+
+// Great-circle distance between two long/lat points, in metres
+func haversineMetres(long1, lat1, long2, lat2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLong := toRad(long2 - long1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadiusMetres * math.Asin(math.Min(1, math.Sqrt(a)))
+}
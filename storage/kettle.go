@@ -1,49 +1,75 @@
 package storage
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgtype"
+	"github.com/jackc/pgx/v4"
 )
 
+// Returned by UpsertKettle when the kettle already exists and whoever's sending it isn't a member,
+// otherwise anyone who knew the wireless id could rename it or change who gets offers.
+var ErrNotKettleMember = errors.New("only members can change a kettle")
+
 type Kettle struct {
-	KettleId     uuid.UUID `json:"kettleId"`
-	WirelessId   string    `json:"wirelessId"`
-	Name         string    `json:"name"`
-	CurrentMaker uuid.UUID `json:"currentMaker"`
+	KettleId   uuid.UUID `json:"kettleId"`
+	WirelessId string    `json:"wirelessId"`
+	Name       string    `json:"name"`
+	// nil if nobody is making
+	CurrentMaker *uuid.UUID `json:"currentMaker"`
 	Long         float64
 	Lat          float64
+	// defaults to nearby when not given
+	NotifyMode NotifyMode `json:"notifyMode"`
 }
 
-func GetKettle(db *sql.DB, kettleId uuid.UUID) (Kettle, error) {
+func (s *PostgresStore) GetKettle(ctx context.Context, kettleId uuid.UUID) (Kettle, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	var k Kettle
+	var currentMaker pgtype.UUID
 	// Is there a nice way to map sturct-fields to rows. i.e. like `json="lowercasedname"`?
-	err := db.QueryRow("SELECT kettle_id, wireless_id, name, current_maker, ST_X(location::geometry), ST_Y(location::geometry) "+
-		"FROM kettles WHERE kettle_id = $1", kettleId).Scan(&k.KettleId, &k.WirelessId, &k.Name, &k.CurrentMaker, &k.Long, &k.Lat)
+	err := s.pool.QueryRow(ctx, "SELECT kettle_id, wireless_id, name, current_maker, ST_X(location::geometry), ST_Y(location::geometry), notify_mode "+
+		"FROM kettles WHERE kettle_id = $1", kettleId).Scan(&k.KettleId, &k.WirelessId, &k.Name, &currentMaker, &k.Long, &k.Lat, &k.NotifyMode)
 	if err != nil {
-		return Kettle{}, err
+		return Kettle{}, notFound(err)
+	}
+	if currentMaker.Status == pgtype.Present {
+		makerId := uuid.UUID(currentMaker.Bytes)
+		k.CurrentMaker = &makerId
 	}
 
 	return k, nil
 }
 
-func (k *Kettle) UpsertKettle(db *sql.DB) (uuid.UUID, error) {
+func (s *PostgresStore) UpsertKettle(ctx context.Context, k *Kettle, userId uuid.UUID) (uuid.UUID, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	setLocationFragment := "SET "
 	if k.Long != 0.0 || k.Lat != 0.0 {
 		setLocationFragment = "SET location=EXCLUDED.location, "
 	}
-	err := db.QueryRow(
-		"INSERT INTO kettles(wireless_id, name, location) "+
-			"VALUES($1, $2, $3) "+
+	err := s.pool.QueryRow(ctx,
+		"INSERT INTO kettles(wireless_id, name, location, notify_mode) "+
+			"VALUES($1, $2, $3, COALESCE(NULLIF($4,''), 'nearby')) "+
 			"ON CONFLICT(wireless_id) DO UPDATE "+
 			setLocationFragment+
 			// this coalesce with nullif, will basically update the column if the update-value is non-null AND not-empty-string
 			"wireless_id=COALESCE(NULLIF(EXCLUDED.wireless_id,''), kettles.wireless_id),"+
-			"name=COALESCE(NULLIF(EXCLUDED.name,''), kettles.name) "+
-			"RETURNING kettle_id",
-		k.WirelessId, k.Name, fmt.Sprintf("POINT(%f %f)", k.Long, k.Lat),
-	).Scan(&k.KettleId)
+			"name=COALESCE(NULLIF(EXCLUDED.name,''), kettles.name),"+
+			// EXCLUDED.notify_mode is never empty thanks to the insert-side COALESCE, so only overwrite if one was given
+			"notify_mode=CASE WHEN $4 = '' THEN kettles.notify_mode ELSE EXCLUDED.notify_mode END "+
+			// no row comes back if they're not a member, so the update doesn't happen
+			"WHERE EXISTS (SELECT 1 FROM kettle_members m WHERE m.kettle_id = kettles.kettle_id AND m.user_id = $5) "+
+			"RETURNING kettle_id, notify_mode",
+		k.WirelessId, k.Name, fmt.Sprintf("POINT(%f %f)", k.Long, k.Lat), k.NotifyMode, userId,
+	).Scan(&k.KettleId, &k.NotifyMode)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.UUID{}, ErrNotKettleMember
+	}
 	if err != nil {
 		return uuid.UUID{}, err
 	}
@@ -51,25 +77,9 @@ func (k *Kettle) UpsertKettle(db *sql.DB) (uuid.UUID, error) {
 	return k.KettleId, nil
 }
 
-// could prob also achieve this with upsert but meh
-// (actually upsert is hard because we SPECIFICALLY want to blank/NULL it. so hard to differentiate between
-// a) we actually want to null.
-// b) we want to leave it as it is.
-func SetCurrentMaker(db *sql.DB, kettleId, userId uuid.UUID) error {
-	var kid uuid.UUID
-	if (userId == uuid.UUID{}) {
-		return db.QueryRow(
-			"UPDATE kettles SET current_maker = null WHERE kettle_id = $1 returning kettle_id",
-			kettleId,
-		).Scan(&kid)
-	}
-	return db.QueryRow(
-		"UPDATE kettles SET current_maker = $2 WHERE kettle_id = $1 returning kettle_id",
-		kettleId, userId,
-	).Scan(&kid)
-}
-
-func GetKettlesWithinRadius(db *sql.DB, long, lat float64, metreRadius int32) ([]Kettle, error) {
+func (s *PostgresStore) GetKettlesWithinRadius(ctx context.Context, long, lat float64, metreRadius int32) ([]Kettle, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	// get all kettles in surrounding area.
 	// "join" a kettle means.....?
 	// maybe have a connected_kettle_id in users. and just update it
@@ -79,7 +89,7 @@ func GetKettlesWithinRadius(db *sql.DB, long, lat float64, metreRadius int32) ([
 	// Maybe can just check geolocation before send the notification,
 	// however a) is it possible to trigger a location sync without notifying user.
 	// b) would be nice to list who is going to be available/notified for kettle-round.
-	rows, err := db.Query(
+	rows, err := s.pool.Query(ctx,
 		"SELECT kettle_id, wireless_id, name FROM kettles "+
 			"WHERE ST_DWithin(location, ST_MakePoint($1,$2)::geography, $3) "+
 			"ORDER BY ST_Distance(location, ST_MakePoint($1,$2)::geography)", long, lat, metreRadius,
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUpsertKettleMembersOnly(t *testing.T) {
+	forEachStore(t, testUpsertKettleMembersOnly)
+}
+
+func testUpsertKettleMembersOnly(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice, bob := testUser(t, s, "alice"), testUser(t, s, "bob")
+	k := testKettle(t, s)
+	if err := s.AddKettleMember(ctx, k.KettleId, alice.UserId); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.RemoveKettleMember(ctx, k.KettleId, alice.UserId)
+		s.RemoveKettleMember(ctx, k.KettleId, bob.UserId)
+	})
+
+	renamed := Kettle{WirelessId: k.WirelessId, Name: "bob's kettle", NotifyMode: NotifyMembers}
+	if _, err := s.UpsertKettle(ctx, &renamed, bob.UserId); !errors.Is(err, ErrNotKettleMember) {
+		t.Fatalf("expected ErrNotKettleMember, got %v", err)
+	}
+	got, err := s.GetKettle(ctx, k.KettleId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != k.Name || got.NotifyMode != k.NotifyMode {
+		t.Errorf("a non-member shouldn't be able to change the kettle, got %+v", got)
+	}
+
+	renamed = Kettle{WirelessId: k.WirelessId, Name: "alice's kettle"}
+	if _, err := s.UpsertKettle(ctx, &renamed, alice.UserId); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetKettle(ctx, k.KettleId); err != nil {
+		t.Fatal(err)
+	} else if got.Name != "alice's kettle" {
+		t.Errorf("a member should be able to rename the kettle, got %q", got.Name)
+	}
+}
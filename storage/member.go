@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Who gets notified when someone offers to make a round on a kettle
+type NotifyMode string
+
+const (
+	NotifyNearby        NotifyMode = "nearby"
+	NotifyMembers       NotifyMode = "members"
+	NotifyNearbyMembers NotifyMode = "nearby_members"
+)
+
+func (m NotifyMode) IsValid() bool {
+	return m == NotifyNearby || m == NotifyMembers || m == NotifyNearbyMembers
+}
+
+type KettleMember struct {
+	UserId   uuid.UUID `json:"userId"`
+	Nickname string    `json:"nickname"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// Joining a kettle you're already a member of is a no-op
+func (s *PostgresStore) AddKettleMember(ctx context.Context, kettleId, userId uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx,
+		"INSERT INTO kettle_members(kettle_id, user_id) VALUES($1, $2) ON CONFLICT DO NOTHING",
+		kettleId, userId,
+	)
+	return err
+}
+
+// Returns false if they weren't a member in the first place
+func (s *PostgresStore) RemoveKettleMember(ctx context.Context, kettleId, userId uuid.UUID) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.pool.Exec(ctx, "DELETE FROM kettle_members WHERE kettle_id = $1 AND user_id = $2", kettleId, userId)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (s *PostgresStore) GetKettleMembers(ctx context.Context, kettleId uuid.UUID) ([]KettleMember, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx,
+		"SELECT m.user_id, u.default_nickname, m.joined_at FROM kettle_members m JOIN appusers u USING (user_id) "+
+			"WHERE m.kettle_id = $1 ORDER BY m.joined_at", kettleId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]KettleMember, 0)
+
+	for rows.Next() {
+		var m KettleMember
+		if err := rows.Scan(&m.UserId, &m.Nickname, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+
+	return members, rows.Err()
+}
+
+func (s *PostgresStore) IsKettleMember(ctx context.Context, kettleId, userId uuid.UUID) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var isMember bool
+	err := s.pool.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM kettle_members WHERE kettle_id = $1 AND user_id = $2)", kettleId, userId,
+	).Scan(&isMember)
+	return isMember, err
+}
+
+func (s *PostgresStore) IsUserNearKettle(ctx context.Context, kettleId, userId uuid.UUID, metreRadius int32) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var isNear bool
+	err := s.pool.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM kettles k, appusers u WHERE k.kettle_id = $1 AND u.user_id = $2 "+
+			"AND ST_DWithin(u.last_known_location, k.location, $3))", kettleId, userId, metreRadius,
+	).Scan(&isNear)
+	return isNear, err
+}
+
+// Everyone who should hear about an offer on this kettle, depending on its NotifyMode
+func (s *PostgresStore) GetOfferRecipients(ctx context.Context, k Kettle, metreRadius int32) ([]User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	switch k.NotifyMode {
+	case NotifyMembers:
+		return s.queryUsers(ctx,
+			"SELECT u.user_id, u.default_nickname, u.the_usual, u.the_usual_order FROM appusers u "+
+				"JOIN kettle_members m USING (user_id) WHERE m.kettle_id = $1", k.KettleId,
+		)
+	case NotifyNearbyMembers:
+		return s.queryUsers(ctx,
+			"SELECT u.user_id, u.default_nickname, u.the_usual, u.the_usual_order FROM appusers u "+
+				"JOIN kettle_members m USING (user_id) WHERE m.kettle_id = $1 "+
+				"AND ST_DWithin(u.last_known_location, ST_MakePoint($2,$3)::geography, $4)", k.KettleId, k.Long, k.Lat, metreRadius,
+		)
+	default:
+		return s.GetUsersWithinRadius(ctx, k.Long, k.Lat, metreRadius)
+	}
+}
@@ -0,0 +1,788 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Store that keeps everything in maps. Nothing survives a restart, it's for running the app (and poking handlers)
+// without a PostGIS server. Radius queries use haversine distance instead of ST_DWithin.
+type MemoryStore struct {
+	mu       sync.Mutex
+	users    map[uuid.UUID]User
+	kettles  map[uuid.UUID]Kettle
+	members  map[uuid.UUID]map[uuid.UUID]time.Time // kettleId -> userId -> joined at
+	rounds   map[uuid.UUID]Round
+	requests map[uuid.UUID]DrinkRequest
+	outbox   map[uuid.UUID]OutboxNotification
+	devices  map[uuid.UUID]Device
+	menus    map[uuid.UUID]Menu      // kettleId -> menu
+	nudges   map[uuid.UUID]time.Time // kettleId -> last nudged at
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:    make(map[uuid.UUID]User),
+		kettles:  make(map[uuid.UUID]Kettle),
+		members:  make(map[uuid.UUID]map[uuid.UUID]time.Time),
+		rounds:   make(map[uuid.UUID]Round),
+		requests: make(map[uuid.UUID]DrinkRequest),
+		outbox:   make(map[uuid.UUID]OutboxNotification),
+		devices:  make(map[uuid.UUID]Device),
+		menus:    make(map[uuid.UUID]Menu),
+		nudges:   make(map[uuid.UUID]time.Time),
+	}
+}
+
+func (s *MemoryStore) UpsertUser(ctx context.Context, u *User) (uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u.UserId == uuid.Nil {
+		u.UserId = uuid.New()
+		s.users[u.UserId] = *u
+		return u.UserId, nil
+	}
+	existing, ok := s.users[u.UserId]
+	if !ok {
+		return uuid.UUID{}, ErrNotFound
+	}
+	// same rules as the postgres update: only overwrite with non-empty values
+	if u.LastKnownLong != 0.0 || u.LastKnownLat != 0.0 {
+		existing.LastKnownLong, existing.LastKnownLat = u.LastKnownLong, u.LastKnownLat
+	}
+	if u.DefaultNickname != "" {
+		existing.DefaultNickname = u.DefaultNickname
+	}
+	if u.TheUsualOrder != nil {
+		existing.TheUsual, existing.TheUsualOrder = u.TheUsual, u.TheUsualOrder
+	} else if u.TheUsual != "" {
+		existing.TheUsual, existing.TheUsualOrder = u.TheUsual, nil
+	}
+	s.users[u.UserId] = existing
+	return u.UserId, nil
+}
+
+func (s *MemoryStore) GetUser(ctx context.Context, userId uuid.UUID) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userId]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (s *MemoryStore) GetUserIdFromToken(ctx context.Context, firebaseToken string) (uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d, ok := s.deviceByToken(firebaseToken); ok {
+		return d.UserId, nil
+	}
+	return uuid.UUID{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetUsersWithinRadius(ctx context.Context, long, lat float64, metreRadius int32) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]User, 0)
+	for _, u := range s.users {
+		if haversineMetres(long, lat, u.LastKnownLong, u.LastKnownLat) <= float64(metreRadius) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) RegisterDevice(ctx context.Context, d *Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.deviceByToken(d.FirebaseToken); ok {
+		if existing.UserId != d.UserId {
+			return ErrDeviceTaken
+		}
+		if d.Name != "" {
+			existing.Name = d.Name
+		}
+		existing.InvalidSince = nil
+		s.devices[existing.DeviceId] = existing
+		*d = existing
+		return nil
+	}
+	d.DeviceId = uuid.New()
+	d.RegisteredAt = time.Now().UTC()
+	d.InvalidSince = nil
+	s.devices[d.DeviceId] = *d
+	return nil
+}
+
+func (s *MemoryStore) RemoveDevice(ctx context.Context, userId, deviceId uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[deviceId]
+	if !ok || d.UserId != userId {
+		return false, nil
+	}
+	delete(s.devices, deviceId)
+	return true, nil
+}
+
+func (s *MemoryStore) GetUserDevices(ctx context.Context, userId uuid.UUID) ([]Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices := make([]Device, 0)
+	for _, d := range s.devices {
+		if d.UserId == userId {
+			devices = append(devices, d)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].RegisteredAt.Before(devices[j].RegisteredAt) })
+	return devices, nil
+}
+
+func (s *MemoryStore) GetNotifiableDevices(ctx context.Context, userIds []uuid.UUID) ([]Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wanted := make(map[uuid.UUID]bool, len(userIds))
+	for _, id := range userIds {
+		wanted[id] = true
+	}
+	devices := make([]Device, 0)
+	for _, d := range s.devices {
+		if wanted[d.UserId] && d.InvalidSince == nil {
+			devices = append(devices, d)
+		}
+	}
+	return devices, nil
+}
+
+func (s *MemoryStore) InvalidateFirebaseToken(ctx context.Context, firebaseToken string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deviceByToken(firebaseToken)
+	if !ok || d.InvalidSince != nil {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	d.InvalidSince = &now
+	s.devices[d.DeviceId] = d
+	return true, nil
+}
+
+// caller must hold s.mu
+func (s *MemoryStore) deviceByToken(firebaseToken string) (Device, bool) {
+	for _, d := range s.devices {
+		if d.FirebaseToken == firebaseToken {
+			return d, true
+		}
+	}
+	return Device{}, false
+}
+
+func (s *MemoryStore) UpsertKettle(ctx context.Context, k *Kettle, userId uuid.UUID) (uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, existing := range s.kettles {
+		if existing.WirelessId != k.WirelessId {
+			continue
+		}
+		if _, ok := s.members[id][userId]; !ok {
+			return uuid.UUID{}, ErrNotKettleMember
+		}
+		if k.Long != 0.0 || k.Lat != 0.0 {
+			existing.Long, existing.Lat = k.Long, k.Lat
+		}
+		if k.Name != "" {
+			existing.Name = k.Name
+		}
+		if k.NotifyMode != "" {
+			existing.NotifyMode = k.NotifyMode
+		}
+		s.kettles[id] = existing
+		k.KettleId, k.NotifyMode = id, existing.NotifyMode
+		return id, nil
+	}
+	k.KettleId = uuid.New()
+	if k.NotifyMode == "" {
+		k.NotifyMode = NotifyNearby
+	}
+	k.CurrentMaker = nil
+	s.kettles[k.KettleId] = *k
+	return k.KettleId, nil
+}
+
+func (s *MemoryStore) GetKettle(ctx context.Context, kettleId uuid.UUID) (Kettle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.kettles[kettleId]
+	if !ok {
+		return Kettle{}, ErrNotFound
+	}
+	return k, nil
+}
+
+func (s *MemoryStore) GetKettlesWithinRadius(ctx context.Context, long, lat float64, metreRadius int32) ([]Kettle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kettles := make([]Kettle, 0)
+	for _, k := range s.kettles {
+		if haversineMetres(long, lat, k.Long, k.Lat) <= float64(metreRadius) {
+			kettles = append(kettles, k)
+		}
+	}
+	sort.Slice(kettles, func(i, j int) bool {
+		return haversineMetres(long, lat, kettles[i].Long, kettles[i].Lat) < haversineMetres(long, lat, kettles[j].Long, kettles[j].Lat)
+	})
+	return kettles, nil
+}
+
+func (s *MemoryStore) AddKettleMember(ctx context.Context, kettleId, userId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.kettles[kettleId]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.users[userId]; !ok {
+		return ErrNotFound
+	}
+	if s.members[kettleId] == nil {
+		s.members[kettleId] = make(map[uuid.UUID]time.Time)
+	}
+	if _, ok := s.members[kettleId][userId]; !ok {
+		s.members[kettleId][userId] = time.Now().UTC()
+	}
+	return nil
+}
+
+func (s *MemoryStore) RemoveKettleMember(ctx context.Context, kettleId, userId uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.members[kettleId][userId]; !ok {
+		return false, nil
+	}
+	delete(s.members[kettleId], userId)
+	return true, nil
+}
+
+func (s *MemoryStore) GetKettleMembers(ctx context.Context, kettleId uuid.UUID) ([]KettleMember, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]KettleMember, 0, len(s.members[kettleId]))
+	for userId, joinedAt := range s.members[kettleId] {
+		members = append(members, KettleMember{UserId: userId, Nickname: s.users[userId].DefaultNickname, JoinedAt: joinedAt})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].JoinedAt.Before(members[j].JoinedAt) })
+	return members, nil
+}
+
+func (s *MemoryStore) IsKettleMember(ctx context.Context, kettleId, userId uuid.UUID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.members[kettleId][userId]
+	return ok, nil
+}
+
+func (s *MemoryStore) IsUserNearKettle(ctx context.Context, kettleId, userId uuid.UUID, metreRadius int32) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.kettles[kettleId]
+	if !ok {
+		return false, nil
+	}
+	u, ok := s.users[userId]
+	if !ok {
+		return false, nil
+	}
+	return haversineMetres(k.Long, k.Lat, u.LastKnownLong, u.LastKnownLat) <= float64(metreRadius), nil
+}
+
+func (s *MemoryStore) GetKettleRota(ctx context.Context, kettleId uuid.UUID) ([]RotaEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byUser := make(map[uuid.UUID]*RotaEntry, len(s.members[kettleId]))
+	rota := make([]RotaEntry, 0, len(s.members[kettleId]))
+	for userId, joinedAt := range s.members[kettleId] {
+		rota = append(rota, RotaEntry{UserId: userId, Nickname: s.users[userId].DefaultNickname, JoinedAt: joinedAt})
+	}
+	for i := range rota {
+		byUser[rota[i].UserId] = &rota[i]
+	}
+	for _, round := range s.rounds {
+		if round.KettleId != kettleId || round.State != RoundDelivered {
+			continue
+		}
+		if maker, ok := byUser[round.MakerId]; ok {
+			maker.RoundsMade++
+			if maker.LastMadeAt == nil || round.FinishedAt.After(*maker.LastMadeAt) {
+				maker.LastMadeAt = round.FinishedAt
+			}
+		}
+	}
+	for _, dr := range s.madeDrinks() {
+		round := s.rounds[dr.RoundId]
+		if round.KettleId != kettleId || dr.UserId == round.MakerId {
+			continue
+		}
+		if maker, ok := byUser[round.MakerId]; ok {
+			maker.CupsMade++
+		}
+		if drinker, ok := byUser[dr.UserId]; ok {
+			drinker.CupsDrunk++
+		}
+	}
+	sortRota(rota)
+	return rota, nil
+}
+
+// Every drink that actually got made, same rules as madeDrinksCte. caller must hold s.mu
+func (s *MemoryStore) madeDrinks() []DrinkRequest {
+	ticked := make(map[uuid.UUID]bool)
+	for _, dr := range s.requests {
+		if dr.DoneAt != nil {
+			ticked[dr.RoundId] = true
+		}
+	}
+	made := make([]DrinkRequest, 0)
+	for _, dr := range s.requests {
+		if s.rounds[dr.RoundId].State == RoundDelivered && (dr.DoneAt != nil || !ticked[dr.RoundId]) {
+			made = append(made, dr)
+		}
+	}
+	return made
+}
+
+func (s *MemoryStore) GetUserStats(ctx context.Context, userId uuid.UUID, since time.Time, loc *time.Location) (UserStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := UserStats{}
+	favourites := make(map[string]int)
+	hours := make(map[int]int)
+	rounds := make(map[uuid.UUID]bool)
+	for _, dr := range s.madeDrinks() {
+		round := s.rounds[dr.RoundId]
+		if round.OfferedAt.Before(since) || (dr.UserId != userId && round.MakerId != userId) {
+			continue
+		}
+		if dr.UserId == userId {
+			stats.CupsDrunk++
+			favourites[drinkLabel(dr)]++
+		}
+		if round.MakerId == userId {
+			stats.CupsMade++
+		}
+		if !rounds[round.RoundId] {
+			rounds[round.RoundId] = true
+			hours[round.OfferedAt.In(loc).Hour()]++
+		}
+	}
+	var total time.Duration
+	for _, round := range s.rounds {
+		if round.MakerId == userId && round.State == RoundDelivered && !round.OfferedAt.Before(since) {
+			stats.RoundsMade++
+			total += round.FinishedAt.Sub(round.OfferedAt)
+		}
+	}
+	if stats.RoundsMade > 0 {
+		avg := total.Seconds() / float64(stats.RoundsMade)
+		stats.AverageRoundSeconds = &avg
+	}
+	stats.FavouriteDrinks = topDrinkCounts(favourites, FavouriteDrinksLimit)
+	stats.Hours = fillHours(hours)
+	return stats, nil
+}
+
+func (s *MemoryStore) GetKettleStats(ctx context.Context, kettleId uuid.UUID, since time.Time, loc *time.Location) (KettleStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := KettleStats{}
+	hours := make(map[int]int)
+	var total time.Duration
+	for _, round := range s.rounds {
+		if round.KettleId == kettleId && round.State == RoundDelivered && !round.OfferedAt.Before(since) {
+			stats.Rounds++
+			total += round.FinishedAt.Sub(round.OfferedAt)
+			hours[round.OfferedAt.In(loc).Hour()]++
+		}
+	}
+	if stats.Rounds > 0 {
+		avg := total.Seconds() / float64(stats.Rounds)
+		stats.AverageRoundSeconds = &avg
+	}
+	favourites := make(map[string]int)
+	made := make(map[uuid.UUID]int)
+	drunk := make(map[uuid.UUID]int)
+	for _, dr := range s.madeDrinks() {
+		round := s.rounds[dr.RoundId]
+		if round.KettleId != kettleId || round.OfferedAt.Before(since) {
+			continue
+		}
+		stats.Cups++
+		favourites[drinkLabel(dr)]++
+		made[round.MakerId]++
+		drunk[dr.UserId]++
+	}
+	stats.Drinkers = len(drunk)
+	stats.FavouriteDrinks = topDrinkCounts(favourites, FavouriteDrinksLimit)
+	stats.Hours = fillHours(hours)
+	stats.TopMakers = s.leaderboard(made, LeaderboardLimit)
+	stats.TopDrinkers = s.leaderboard(drunk, LeaderboardLimit)
+	return stats, nil
+}
+
+// most first, ties by nickname, cut down to limit. caller must hold s.mu
+func (s *MemoryStore) leaderboard(counts map[uuid.UUID]int, limit int) []LeaderboardEntry {
+	board := make([]LeaderboardEntry, 0, len(counts))
+	for userId, count := range counts {
+		board = append(board, LeaderboardEntry{UserId: userId, Nickname: s.users[userId].DefaultNickname, Count: count})
+	}
+	sort.Slice(board, func(i, j int) bool {
+		if board[i].Count != board[j].Count {
+			return board[i].Count > board[j].Count
+		}
+		return board[i].Nickname < board[j].Nickname
+	})
+	if len(board) > limit {
+		board = board[:limit]
+	}
+	return board
+}
+
+func (s *MemoryStore) MarkKettleNudged(ctx context.Context, kettleId uuid.UUID, notBefore time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.nudges[kettleId]; ok && !last.Before(notBefore) {
+		return false, nil
+	}
+	s.nudges[kettleId] = time.Now().UTC()
+	return true, nil
+}
+
+func (s *MemoryStore) GetKettleMenu(ctx context.Context, kettleId uuid.UUID) (Menu, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	menu := append(make(Menu, 0, len(s.menus[kettleId])), s.menus[kettleId]...)
+	sort.Slice(menu, func(i, j int) bool {
+		if menu[i].Kind != menu[j].Kind {
+			return menu[i].Kind < menu[j].Kind
+		}
+		return menu[i].Item < menu[j].Item
+	})
+	return menu, nil
+}
+
+func (s *MemoryStore) SetKettleMenu(ctx context.Context, kettleId, updatedBy uuid.UUID, menu Menu) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.kettles[kettleId]; !ok {
+		return ErrNotFound
+	}
+	now := time.Now().UTC()
+	existing := s.menus[kettleId]
+	replaced := make(Menu, 0, len(menu))
+	for _, i := range menu {
+		if old, ok := existing.find(i.Kind, i.Item); ok && old.InStock == i.InStock {
+			i = old
+		} else {
+			i.UpdatedBy, i.UpdatedAt = &updatedBy, now
+		}
+		replaced = append(replaced, i)
+	}
+	s.menus[kettleId] = replaced
+	return nil
+}
+
+func (s *MemoryStore) SetMenuItemStock(ctx context.Context, kettleId, updatedBy uuid.UUID, kind MenuKind, item string, inStock bool) (MenuItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n, i := range s.menus[kettleId] {
+		if i.Kind == kind && i.Item == item {
+			i.InStock, i.UpdatedBy, i.UpdatedAt = inStock, &updatedBy, time.Now().UTC()
+			s.menus[kettleId][n] = i
+			return i, nil
+		}
+	}
+	return MenuItem{}, ErrNotFound
+}
+
+func (s *MemoryStore) GetOfferRecipients(ctx context.Context, k Kettle, metreRadius int32) ([]User, error) {
+	if k.NotifyMode != NotifyMembers && k.NotifyMode != NotifyNearbyMembers {
+		return s.GetUsersWithinRadius(ctx, k.Long, k.Lat, metreRadius)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]User, 0)
+	for userId := range s.members[k.KettleId] {
+		u := s.users[userId]
+		if k.NotifyMode == NotifyNearbyMembers && haversineMetres(k.Long, k.Lat, u.LastKnownLong, u.LastKnownLat) > float64(metreRadius) {
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func (s *MemoryStore) ClaimKettle(ctx context.Context, kettleId, makerId uuid.UUID, takeOver bool, staleAfter time.Duration) (Round, *Round, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kettle, ok := s.kettles[kettleId]
+	if !ok {
+		return Round{}, nil, ErrNotFound
+	}
+	now := time.Now().UTC()
+	var cancelled *Round
+	if existing, ok := s.activeRound(kettleId); ok {
+		if !takeOver || now.Sub(existing.UpdatedAt) < staleAfter {
+			return Round{}, nil, &KettleBusyError{Round: existing, MakerNickname: s.users[existing.MakerId].DefaultNickname}
+		}
+		existing.State, existing.UpdatedAt, existing.FinishedAt = RoundCancelled, now, &now
+		s.rounds[existing.RoundId] = existing
+		cancelled = &existing
+	}
+	r := Round{RoundId: uuid.New(), KettleId: kettleId, MakerId: makerId, State: RoundOffered, OfferedAt: now, UpdatedAt: now}
+	s.rounds[r.RoundId] = r
+	kettle.CurrentMaker = &makerId
+	s.kettles[kettleId] = kettle
+	return r, cancelled, nil
+}
+
+func (s *MemoryStore) GetRound(ctx context.Context, roundId uuid.UUID) (Round, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rounds[roundId]
+	if !ok {
+		return Round{}, ErrNotFound
+	}
+	return r, nil
+}
+
+func (s *MemoryStore) GetActiveRound(ctx context.Context, kettleId uuid.UUID) (Round, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.activeRound(kettleId)
+	if !ok {
+		return Round{}, ErrNoActiveRound
+	}
+	return r, nil
+}
+
+// caller must hold s.mu
+func (s *MemoryStore) activeRound(kettleId uuid.UUID) (Round, bool) {
+	for _, r := range s.rounds {
+		if r.KettleId == kettleId && r.State.IsActive() {
+			return r, true
+		}
+	}
+	return Round{}, false
+}
+
+func (s *MemoryStore) TransitionRound(ctx context.Context, r *Round, to RoundState) error {
+	if !r.State.CanTransitionTo(to) {
+		return ErrIllegalTransition
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.rounds[r.RoundId]
+	if !ok || stored.State != r.State {
+		return ErrIllegalTransition
+	}
+	now := time.Now().UTC()
+	stored.State, stored.UpdatedAt = to, now
+	if !to.IsActive() {
+		stored.FinishedAt = &now
+		if kettle := s.kettles[stored.KettleId]; kettle.CurrentMaker != nil && *kettle.CurrentMaker == stored.MakerId {
+			kettle.CurrentMaker = nil
+			s.kettles[stored.KettleId] = kettle
+		}
+	}
+	s.rounds[r.RoundId] = stored
+	*r = stored
+	return nil
+}
+
+func (s *MemoryStore) GetActiveRoundsOfferedBefore(ctx context.Context, before time.Time) ([]Round, error) {
+	return s.filterRounds(func(r Round) bool {
+		return r.State.IsActive() && r.OfferedAt.Before(before)
+	}), nil
+}
+
+func (s *MemoryStore) GetRoundsNeedingReminder(ctx context.Context, before time.Time) ([]Round, error) {
+	return s.filterRounds(func(r Round) bool {
+		return r.State.IsActive() && r.OfferedAt.Before(before) && r.ReminderSentAt == nil
+	}), nil
+}
+
+func (s *MemoryStore) filterRounds(keep func(Round) bool) []Round {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rounds := make([]Round, 0)
+	for _, r := range s.rounds {
+		if keep(r) {
+			rounds = append(rounds, r)
+		}
+	}
+	sort.Slice(rounds, func(i, j int) bool { return rounds[i].OfferedAt.Before(rounds[j].OfferedAt) })
+	return rounds
+}
+
+func (s *MemoryStore) MarkReminderSent(ctx context.Context, r *Round) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.rounds[r.RoundId]
+	if !ok || stored.ReminderSentAt != nil {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	stored.ReminderSentAt = &now
+	s.rounds[r.RoundId] = stored
+	r.ReminderSentAt = &now
+	return true, nil
+}
+
+func (s *MemoryStore) UpsertDrinkRequest(ctx context.Context, dr *DrinkRequest) (uuid.UUID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if round, ok := s.rounds[dr.RoundId]; !ok || (round.State != RoundOffered && round.State != RoundCollecting) {
+		return uuid.UUID{}, ErrRoundClosed
+	}
+	dr.RequestedAt = time.Now().UTC()
+	dr.DoneAt = nil
+	for id, existing := range s.requests {
+		if existing.RoundId == dr.RoundId && existing.UserId == dr.UserId {
+			dr.RequestId = id
+			s.requests[id] = *dr
+			return id, nil
+		}
+	}
+	dr.RequestId = uuid.New()
+	s.requests[dr.RequestId] = *dr
+	return dr.RequestId, nil
+}
+
+func (s *MemoryStore) GetRoundDrinkRequests(ctx context.Context, roundId uuid.UUID) ([]DrinkRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]DrinkRequest, 0)
+	for _, dr := range s.requests {
+		if dr.RoundId == roundId {
+			dr.Nickname = s.users[dr.UserId].DefaultNickname
+			requests = append(requests, dr)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].RequestedAt.Before(requests[j].RequestedAt) })
+	return requests, nil
+}
+
+func (s *MemoryStore) SetDrinkRequestDone(ctx context.Context, roundId, requestId uuid.UUID, done bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dr, ok := s.requests[requestId]
+	if !ok || dr.RoundId != roundId {
+		return ErrNotFound
+	}
+	if !done {
+		dr.DoneAt = nil
+	} else if dr.DoneAt == nil {
+		now := time.Now().UTC()
+		dr.DoneAt = &now
+	}
+	s.requests[requestId] = dr
+	return nil
+}
+
+func (s *MemoryStore) EnqueueNotifications(ctx context.Context, ns []OutboxNotification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	for i := range ns {
+		ns[i].NotificationId = uuid.New()
+		ns[i].Status = NotificationPending
+		ns[i].NextAttemptAt = now
+		ns[i].CreatedAt = now
+		s.outbox[ns[i].NotificationId] = ns[i]
+	}
+	return nil
+}
+
+func (s *MemoryStore) ClaimDueNotifications(ctx context.Context, limit int, lease time.Duration) ([]OutboxNotification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	due := make([]OutboxNotification, 0)
+	for _, n := range s.outbox {
+		if n.Status == NotificationPending && !n.NextAttemptAt.After(now) {
+			due = append(due, n)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		due[i].Attempts++
+		due[i].NextAttemptAt = now.Add(lease)
+		s.outbox[due[i].NotificationId] = due[i]
+	}
+	return due, nil
+}
+
+func (s *MemoryStore) RenewNotificationLease(ctx context.Context, ns []OutboxNotification, lease time.Duration) ([]OutboxNotification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	kept := make([]OutboxNotification, 0, len(ns))
+	for _, n := range ns {
+		stored, ok := s.outbox[n.NotificationId]
+		if !ok || stored.Status != NotificationPending || stored.Attempts != n.Attempts {
+			continue
+		}
+		stored.NextAttemptAt = now.Add(lease)
+		s.outbox[n.NotificationId] = stored
+		kept = append(kept, n)
+	}
+	return kept, nil
+}
+
+func (s *MemoryStore) MarkNotificationSent(ctx context.Context, notificationId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.outbox[notificationId]
+	if !ok {
+		return nil
+	}
+	now := time.Now().UTC()
+	n.Status = NotificationSent
+	n.SentAt = &now
+	s.outbox[notificationId] = n
+	return nil
+}
+
+func (s *MemoryStore) MarkNotificationFailed(ctx context.Context, notificationId uuid.UUID, lastError string, retryAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.outbox[notificationId]
+	if !ok {
+		return nil
+	}
+	n.LastError = lastError
+	if retryAt == nil {
+		n.Status = NotificationFailed
+	} else {
+		n.NextAttemptAt = *retryAt
+	}
+	s.outbox[notificationId] = n
+	return nil
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// haversine in Go, no PostGIS involved
+func (s *MemoryStore) PostGISVersion(ctx context.Context) (string, error) {
+	return "", nil
+}
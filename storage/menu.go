@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type MenuKind string
+
+const (
+	// items are DrinkType values
+	MenuDrink MenuKind = "drink"
+	// items are MilkType values (apart from none)
+	MenuMilk MenuKind = "milk"
+	// items are SweetenerSugar or SweetenerSweetener
+	MenuSweetener MenuKind = "sweetener"
+)
+
+const (
+	SweetenerSugar     = "sugar"
+	SweetenerSweetener = "sweetener"
+)
+
+// Something a kettle can make, or put in a drink
+type MenuItem struct {
+	Kind    MenuKind `json:"kind"`
+	Item    string   `json:"item"`
+	InStock bool     `json:"inStock"`
+	// who last changed it. nil if they've since deleted their account
+	UpdatedBy *uuid.UUID `json:"updatedBy"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+// Error messages are meant for showing to whoever sent the item
+func (i MenuItem) Validate() error {
+	switch i.Kind {
+	case MenuDrink:
+		if !oneOf(i.Item, drinkTypes) {
+			return fmt.Errorf("drink must be one of %s", strings.Join(drinkTypes, ", "))
+		}
+	case MenuMilk:
+		if i.Item == string(MilkNone) || !oneOf(i.Item, milkTypes) {
+			return fmt.Errorf("milk must be one of %s", strings.Join(milkTypes[1:], ", "))
+		}
+	case MenuSweetener:
+		if i.Item != SweetenerSugar && i.Item != SweetenerSweetener {
+			return fmt.Errorf("sweetener must be one of %s, %s", SweetenerSugar, SweetenerSweetener)
+		}
+	default:
+		return fmt.Errorf("kind must be one of %s, %s, %s", MenuDrink, MenuMilk, MenuSweetener)
+	}
+	return nil
+}
+
+// e.g. "green tea", "oat milk", "sugar"
+func (i MenuItem) Label() string {
+	label := strings.ReplaceAll(i.Item, "_", " ")
+	if i.Kind == MenuMilk {
+		if i.Item == string(MilkCow) {
+			return "milk"
+		}
+		label += " milk"
+	}
+	return label
+}
+
+type Menu []MenuItem
+
+func (m Menu) find(kind MenuKind, item string) (MenuItem, bool) {
+	for _, i := range m {
+		if i.Kind == kind && i.Item == item {
+			return i, true
+		}
+	}
+	return MenuItem{}, false
+}
+
+func (m Menu) hasKind(kind MenuKind) bool {
+	for _, i := range m {
+		if i.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Labels of whatever's on the menu but run out
+func (m Menu) OutOfStock() []string {
+	out := make([]string, 0)
+	for _, i := range m {
+		if !i.InStock {
+			out = append(out, i.Label())
+		}
+	}
+	return out
+}
+
+// Labels of everything in the order the kettle can't do right now, because it's run out or isn't on the menu.
+// A kind the menu says nothing about (e.g. it only lists drinks) doesn't restrict anything.
+func (m Menu) Unavailable(o DrinkOrder) []string {
+	wanted := []MenuItem{{Kind: MenuDrink, Item: string(o.Drink)}}
+	if o.Milk != "" && o.Milk != MilkNone {
+		wanted = append(wanted, MenuItem{Kind: MenuMilk, Item: string(o.Milk)})
+	}
+	if o.Sugars > 0 {
+		wanted = append(wanted, MenuItem{Kind: MenuSweetener, Item: SweetenerSugar})
+	}
+	if o.Sweeteners > 0 {
+		wanted = append(wanted, MenuItem{Kind: MenuSweetener, Item: SweetenerSweetener})
+	}
+	unavailable := make([]string, 0)
+	for _, w := range wanted {
+		if !m.hasKind(w.Kind) {
+			continue
+		}
+		if i, ok := m.find(w.Kind, w.Item); !ok || !i.InStock {
+			unavailable = append(unavailable, w.Label())
+		}
+	}
+	return unavailable
+}
+
+// Best guess for free text orders, which can't be checked properly: labels of run out items the text mentions.
+func (m Menu) MentionedOutOfStock(text string) []string {
+	text = strings.ToLower(text)
+	mentioned := make([]string, 0)
+	for _, i := range m {
+		if !i.InStock && strings.Contains(text, i.Label()) {
+			mentioned = append(mentioned, i.Label())
+		}
+	}
+	return mentioned
+}
+
+const menuColumns = "kind, item, in_stock, updated_by, updated_at"
+
+func (i *MenuItem) scanFields() []interface{} {
+	return []interface{}{&i.Kind, &i.Item, &i.InStock, &i.UpdatedBy, &i.UpdatedAt}
+}
+
+func (s *PostgresStore) GetKettleMenu(ctx context.Context, kettleId uuid.UUID) (Menu, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx,
+		"SELECT "+menuColumns+" FROM kettle_menu_items WHERE kettle_id = $1 ORDER BY kind, item", kettleId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	menu := make(Menu, 0)
+
+	for rows.Next() {
+		var i MenuItem
+		if err := rows.Scan(i.scanFields()...); err != nil {
+			return nil, err
+		}
+		menu = append(menu, i)
+	}
+
+	return menu, rows.Err()
+}
+
+// Replaces the kettle's whole menu. Items that were already on it keep their stock flag unless it's changed.
+func (s *PostgresStore) SetKettleMenu(ctx context.Context, kettleId, updatedBy uuid.UUID, menu Menu) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	kinds, items := make([]string, len(menu)), make([]string, len(menu))
+	for n, i := range menu {
+		kinds[n], items[n] = string(i.Kind), i.Item
+	}
+	if _, err := tx.Exec(ctx,
+		"DELETE FROM kettle_menu_items WHERE kettle_id = $1 "+
+			"AND (kind, item) NOT IN (SELECT * FROM unnest($2::text[], $3::text[]))",
+		kettleId, kinds, items,
+	); err != nil {
+		return err
+	}
+	for _, i := range menu {
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO kettle_menu_items(kettle_id, kind, item, in_stock, updated_by) VALUES($1, $2, $3, $4, $5) "+
+				"ON CONFLICT(kettle_id, kind, item) DO UPDATE "+
+				"SET in_stock=EXCLUDED.in_stock, updated_by=EXCLUDED.updated_by, updated_at=now() "+
+				"WHERE kettle_menu_items.in_stock <> EXCLUDED.in_stock",
+			kettleId, i.Kind, i.Item, i.InStock, updatedBy,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// Marks something on the menu as run out (or back in). ErrNotFound if it isn't on the kettle's menu.
+func (s *PostgresStore) SetMenuItemStock(ctx context.Context, kettleId, updatedBy uuid.UUID, kind MenuKind, item string, inStock bool) (MenuItem, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var i MenuItem
+	err := s.pool.QueryRow(ctx,
+		"UPDATE kettle_menu_items SET in_stock = $4, updated_by = $5, updated_at = now() "+
+			"WHERE kettle_id = $1 AND kind = $2 AND item = $3 RETURNING "+menuColumns,
+		kettleId, kind, item, inStock, updatedBy,
+	).Scan(i.scanFields()...)
+	return i, notFound(err)
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type NotificationStatus string
+
+const (
+	NotificationPending NotificationStatus = "pending"
+	NotificationSent    NotificationStatus = "sent"
+	// gave up after too many attempts
+	NotificationFailed NotificationStatus = "failed"
+)
+
+// A push notification queued for one recipient
+type OutboxNotification struct {
+	NotificationId uuid.UUID          `json:"notificationId"`
+	UserId         uuid.UUID          `json:"userId"`
+	Token          string             `json:"-"`
+	Title          string             `json:"title"`
+	Body           string             `json:"body"`
+	Data           map[string]string  `json:"data"`
+	Status         NotificationStatus `json:"status"`
+	Attempts       int                `json:"attempts"`
+	NextAttemptAt  time.Time          `json:"nextAttemptAt"`
+	LastError      string             `json:"lastError"`
+	CreatedAt      time.Time          `json:"createdAt"`
+	SentAt         *time.Time         `json:"sentAt"`
+}
+
+const notificationColumns = "notification_id, user_id, token, title, body, data, status, attempts, next_attempt_at, last_error, created_at, sent_at"
+
+func (n *OutboxNotification) scanFields() []interface{} {
+	return []interface{}{&n.NotificationId, &n.UserId, &n.Token, &n.Title, &n.Body, &n.Data, &n.Status, &n.Attempts, &n.NextAttemptAt, &n.LastError, &n.CreatedAt, &n.SentAt}
+}
+
+// Queues the notifications in one go, filling in their ids/status etc.
+func (s *PostgresStore) EnqueueNotifications(ctx context.Context, ns []OutboxNotification) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for i := range ns {
+		err := tx.QueryRow(ctx,
+			"INSERT INTO notification_outbox(user_id, token, title, body, data) VALUES($1, $2, $3, $4, $5) RETURNING "+notificationColumns,
+			ns[i].UserId, ns[i].Token, ns[i].Title, ns[i].Body, ns[i].Data,
+		).Scan(ns[i].scanFields()...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// Up to limit pending notifications that are due, oldest first. Each has its attempts bumped and is pushed back
+// by lease, so no other worker picks it up while this one is sending (but it does get retried if this one dies).
+// SKIP LOCKED lets several instances claim at once without handing out the same rows.
+func (s *PostgresStore) ClaimDueNotifications(ctx context.Context, limit int, lease time.Duration) ([]OutboxNotification, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx,
+		"UPDATE notification_outbox SET attempts = attempts + 1, next_attempt_at = now() + $3 * interval '1 second', updated_at = now() "+
+			"WHERE notification_id IN ("+
+			"SELECT notification_id FROM notification_outbox WHERE status = $1 AND next_attempt_at <= now() "+
+			"ORDER BY next_attempt_at LIMIT $2 FOR UPDATE SKIP LOCKED"+
+			") RETURNING "+notificationColumns,
+		NotificationPending, limit, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ns := make([]OutboxNotification, 0)
+
+	for rows.Next() {
+		var n OutboxNotification
+		if err := rows.Scan(n.scanFields()...); err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+
+	return ns, rows.Err()
+}
+
+// A claim is identified by the attempts it bumped to, so if that's moved on someone else has claimed it since.
+func (s *PostgresStore) RenewNotificationLease(ctx context.Context, ns []OutboxNotification, lease time.Duration) ([]OutboxNotification, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	ids := make([]string, len(ns))
+	attempts := make([]int32, len(ns))
+	for i, n := range ns {
+		ids[i] = n.NotificationId.String()
+		attempts[i] = int32(n.Attempts)
+	}
+	rows, err := s.pool.Query(ctx,
+		"UPDATE notification_outbox o SET next_attempt_at = now() + $3 * interval '1 second', updated_at = now() "+
+			"FROM unnest($1::uuid[], $2::int[]) AS c(notification_id, attempts) "+
+			"WHERE o.notification_id = c.notification_id AND o.attempts = c.attempts AND o.status = $4 "+
+			"RETURNING o.notification_id",
+		ids, attempts, lease.Seconds(), NotificationPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	renewed := make(map[uuid.UUID]bool, len(ns))
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		renewed[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	kept := make([]OutboxNotification, 0, len(renewed))
+	for _, n := range ns {
+		if renewed[n.NotificationId] {
+			kept = append(kept, n)
+		}
+	}
+	return kept, nil
+}
+
+func (s *PostgresStore) MarkNotificationSent(ctx context.Context, notificationId uuid.UUID) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx,
+		"UPDATE notification_outbox SET status = $2, sent_at = now(), updated_at = now() WHERE notification_id = $1",
+		notificationId, NotificationSent,
+	)
+	return err
+}
+
+// Records why the send failed. It's tried again at retryAt, or marked failed for good if retryAt is nil.
+func (s *PostgresStore) MarkNotificationFailed(ctx context.Context, notificationId uuid.UUID, lastError string, retryAt *time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	status := NotificationPending
+	if retryAt == nil {
+		status = NotificationFailed
+	}
+	_, err := s.pool.Exec(ctx,
+		"UPDATE notification_outbox SET status = $2, last_error = $3, next_attempt_at = COALESCE($4, next_attempt_at), updated_at = now() "+
+			"WHERE notification_id = $1",
+		notificationId, status, lastError, retryAt,
+	)
+	return err
+}
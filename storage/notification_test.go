@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRenewNotificationLease(t *testing.T) {
+	forEachStore(t, testRenewNotificationLease)
+}
+
+func testRenewNotificationLease(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := testUser(t, s, "alice")
+	ns := []OutboxNotification{{UserId: alice.UserId, Token: "phone-alice", Title: "kettle's on", Data: map[string]string{}}}
+	if err := s.EnqueueNotifications(ctx, ns); err != nil {
+		t.Fatal(err)
+	}
+	if ps, ok := s.(*PostgresStore); ok {
+		t.Cleanup(func() {
+			ps.pool.Exec(ctx, "DELETE FROM notification_outbox WHERE notification_id = $1", ns[0].NotificationId)
+		})
+	}
+	// other tests' notifications might be due too, so claim plenty and pick ours out
+	claim := func() OutboxNotification {
+		t.Helper()
+		claimed, err := s.ClaimDueNotifications(ctx, 1000, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range claimed {
+			if n.NotificationId == ns[0].NotificationId {
+				return n
+			}
+		}
+		t.Fatal("notification wasn't claimed")
+		return OutboxNotification{}
+	}
+
+	// no lease, so it's straight away claimed again, like one whose lease ran out while it was waiting to be sent
+	first := claim()
+	second := claim()
+	if renewed, err := s.RenewNotificationLease(ctx, []OutboxNotification{first}, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if len(renewed) != 0 {
+		t.Errorf("a claim that's been superseded shouldn't be renewed, got %+v", renewed)
+	}
+	if renewed, err := s.RenewNotificationLease(ctx, []OutboxNotification{second}, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if len(renewed) != 1 {
+		t.Fatalf("the latest claim should be renewed, got %+v", renewed)
+	}
+	if claimed, err := s.ClaimDueNotifications(ctx, 1000, 0); err != nil {
+		t.Fatal(err)
+	} else {
+		for _, n := range claimed {
+			if n.NotificationId == ns[0].NotificationId {
+				t.Fatal("a renewed notification shouldn't be claimable until its lease is up")
+			}
+		}
+	}
+
+	if err := s.MarkNotificationSent(ctx, second.NotificationId); err != nil {
+		t.Fatal(err)
+	}
+	if renewed, err := s.RenewNotificationLease(ctx, []OutboxNotification{second}, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if len(renewed) != 0 {
+		t.Errorf("a sent notification shouldn't be renewed, got %+v", renewed)
+	}
+}
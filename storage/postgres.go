@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const DefaultQueryTimeout = 5 * time.Second
+
+// Store backed by postgres + postgis. Schema lives in migrations/.
+type PostgresStore struct {
+	pool *pgxpool.Pool
+	// every call gets at most this long, so a slow DB fails the request rather than hanging it forever
+	queryTimeout time.Duration
+}
+
+var _ Store = (*PostgresStore)(nil)
+
+func NewPostgresStore(pool *pgxpool.Pool, queryTimeout time.Duration) *PostgresStore {
+	if queryTimeout <= 0 {
+		queryTimeout = DefaultQueryTimeout
+	}
+	return &PostgresStore{pool: pool, queryTimeout: queryTimeout}
+}
+
+func (s *PostgresStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.queryTimeout)
+}
+
+// single-row lookups should say ErrNotFound rather than leak pgx.ErrNoRows, so callers don't care which store they've got
+func notFound(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, err := s.pool.Exec(ctx, "SELECT 1")
+	return err
+}
+
+func (s *PostgresStore) PostGISVersion(ctx context.Context) (string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var version string
+	err := s.pool.QueryRow(ctx, "SELECT postgis_lib_version()").Scan(&version)
+	return version, err
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+// How fair a member has been to the rest of the kettle. Your own drink in your own round doesn't count either way.
+type RotaEntry struct {
+	UserId   uuid.UUID `json:"userId"`
+	Nickname string    `json:"nickname"`
+	// drinks they've made for other people
+	CupsMade int `json:"cupsMade"`
+	// drinks other people have made for them
+	CupsDrunk  int `json:"cupsDrunk"`
+	RoundsMade int `json:"roundsMade"`
+	// CupsMade - CupsDrunk. negative means they're in tea debt
+	Balance    int        `json:"balance"`
+	LastMadeAt *time.Time `json:"lastMadeAt"`
+	JoinedAt   time.Time  `json:"joinedAt"`
+}
+
+// Whose turn it is first: most in debt, then whoever made a round longest ago (never counts as longest),
+// then whoever joined first.
+func sortRota(rota []RotaEntry) {
+	for i := range rota {
+		rota[i].Balance = rota[i].CupsMade - rota[i].CupsDrunk
+	}
+	sort.SliceStable(rota, func(i, j int) bool {
+		a, b := rota[i], rota[j]
+		if a.Balance != b.Balance {
+			return a.Balance < b.Balance
+		}
+		if (a.LastMadeAt == nil) != (b.LastMadeAt == nil) {
+			return a.LastMadeAt == nil
+		}
+		if a.LastMadeAt != nil && !a.LastMadeAt.Equal(*b.LastMadeAt) {
+			return a.LastMadeAt.Before(*b.LastMadeAt)
+		}
+		return a.JoinedAt.Before(b.JoinedAt)
+	})
+}
+
+// CTE named made, of every drink that actually got made: its round was delivered and, if the maker ticked any drinks
+// off, it was one of them. restrict narrows down the rounds, e.g. "r.kettle_id = $1".
+func madeDrinksCte(restrict string) string {
+	return "made AS (" +
+		"SELECT dr.request_id, dr.user_id, dr.choice, dr.drink_order, r.round_id, r.kettle_id, r.maker_id, r.offered_at, r.finished_at " +
+		"FROM drink_requests dr JOIN drink_rounds r USING (round_id) " +
+		"WHERE r.state = 'delivered' AND " + restrict + " " +
+		"AND (dr.done_at IS NOT NULL OR NOT EXISTS (SELECT 1 FROM drink_requests t WHERE t.round_id = dr.round_id AND t.done_at IS NOT NULL)))"
+}
+
+func (s *PostgresStore) GetKettleRota(ctx context.Context, kettleId uuid.UUID) ([]RotaEntry, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.pool.Query(ctx,
+		"WITH "+madeDrinksCte("r.kettle_id = $1")+" "+
+			"SELECT m.user_id, u.default_nickname, m.joined_at, "+
+			"(SELECT count(*) FROM made WHERE made.maker_id = m.user_id AND made.user_id <> m.user_id), "+
+			"(SELECT count(*) FROM made WHERE made.user_id = m.user_id AND made.maker_id <> m.user_id), "+
+			"(SELECT count(*) FROM drink_rounds r WHERE r.kettle_id = $1 AND r.maker_id = m.user_id AND r.state = 'delivered'), "+
+			"(SELECT max(r.finished_at) FROM drink_rounds r WHERE r.kettle_id = $1 AND r.maker_id = m.user_id AND r.state = 'delivered') "+
+			"FROM kettle_members m JOIN appusers u USING (user_id) WHERE m.kettle_id = $1",
+		kettleId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rota := make([]RotaEntry, 0)
+
+	for rows.Next() {
+		var e RotaEntry
+		if err := rows.Scan(&e.UserId, &e.Nickname, &e.JoinedAt, &e.CupsMade, &e.CupsDrunk, &e.RoundsMade, &e.LastMadeAt); err != nil {
+			return nil, err
+		}
+		rota = append(rota, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortRota(rota)
+	return rota, nil
+}
+
+// Returns false if the kettle's members were already nudged after notBefore, so nobody should be nudged again yet.
+func (s *PostgresStore) MarkKettleNudged(ctx context.Context, kettleId uuid.UUID, notBefore time.Time) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var nudgedAt time.Time
+	err := s.pool.QueryRow(ctx,
+		"UPDATE kettles SET last_nudged_at = now() "+
+			"WHERE kettle_id = $1 AND (last_nudged_at IS NULL OR last_nudged_at < $2) RETURNING last_nudged_at",
+		kettleId, notBefore,
+	).Scan(&nudgedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+type RoundState string
+
+const (
+	// maker has said they'll make a round, nobody has asked for a drink yet
+	RoundOffered RoundState = "offered"
+	// at least one drink request has come in
+	RoundCollecting RoundState = "collecting"
+	// maker has stopped taking orders and is making the drinks
+	RoundBrewing   RoundState = "brewing"
+	RoundDelivered RoundState = "delivered"
+	RoundCancelled RoundState = "cancelled"
+	RoundExpired   RoundState = "expired"
+)
+
+var (
+	ErrRoundInProgress   = errors.New("kettle already has a round in progress")
+	ErrNoActiveRound     = errors.New("kettle has no round in progress")
+	ErrIllegalTransition = errors.New("illegal round state transition")
+	// the round has moved on from taking orders (or never existed)
+	ErrRoundClosed = errors.New("round isn't taking orders")
+)
+
+// which states a round can move to from each state. terminal states (delivered, cancelled, expired) go nowhere.
+var roundTransitions = map[RoundState][]RoundState{
+	RoundOffered:    {RoundCollecting, RoundCancelled, RoundExpired},
+	RoundCollecting: {RoundBrewing, RoundDelivered, RoundCancelled, RoundExpired},
+	RoundBrewing:    {RoundDelivered, RoundCancelled, RoundExpired},
+}
+
+func (s RoundState) CanTransitionTo(to RoundState) bool {
+	for _, allowed := range roundTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s RoundState) IsActive() bool {
+	return s == RoundOffered || s == RoundCollecting || s == RoundBrewing
+}
+
+type Round struct {
+	RoundId    uuid.UUID  `json:"roundId"`
+	KettleId   uuid.UUID  `json:"kettleId"`
+	MakerId    uuid.UUID  `json:"makerId"`
+	State      RoundState `json:"state"`
+	OfferedAt  time.Time  `json:"offeredAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+	// when the maker was nudged about this round. nil if they haven't been
+	ReminderSentAt *time.Time `json:"reminderSentAt"`
+}
+
+const roundColumns = "round_id, kettle_id, maker_id, state, offered_at, updated_at, finished_at, reminder_sent_at"
+
+func (r *Round) scanFields() []interface{} {
+	return []interface{}{&r.RoundId, &r.KettleId, &r.MakerId, &r.State, &r.OfferedAt, &r.UpdatedAt, &r.FinishedAt, &r.ReminderSentAt}
+}
+
+// Returned by ClaimKettle when somebody else already has a round going on the kettle.
+// errors.Is(err, ErrRoundInProgress) is true for it.
+type KettleBusyError struct {
+	Round         Round
+	MakerNickname string
+}
+
+func (e *KettleBusyError) Error() string {
+	return fmt.Sprintf("%s is already making a round on kettle %s", e.MakerNickname, e.Round.KettleId)
+}
+
+func (e *KettleBusyError) Is(target error) bool {
+	return target == ErrRoundInProgress
+}
+
+// Atomically makes makerId the kettle's current maker and starts a new round.
+// Only succeeds if there's no active round, unless takeOver is set and the round's not been touched for staleAfter,
+// in which case the existing round is cancelled and replaced (and returned). The kettle row is locked for the
+// duration, so two people offering at once are serialised and the loser gets a *KettleBusyError rather than both "winning".
+func (s *PostgresStore) ClaimKettle(ctx context.Context, kettleId, makerId uuid.UUID, takeOver bool, staleAfter time.Duration) (Round, *Round, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return Round{}, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var kid uuid.UUID
+	if err := tx.QueryRow(ctx, "SELECT kettle_id FROM kettles WHERE kettle_id = $1 FOR UPDATE", kettleId).Scan(&kid); err != nil {
+		return Round{}, nil, notFound(err)
+	}
+
+	var existing Round
+	var makerNickname string
+	var stale bool
+	// staleness is worked out by the db, so it's against the same clock that set updated_at
+	err = tx.QueryRow(ctx,
+		"SELECT "+prefixColumns("r", roundColumns)+", u.default_nickname, r.updated_at <= now() - make_interval(secs => $5) "+
+			"FROM drink_rounds r JOIN appusers u ON u.user_id = r.maker_id "+
+			"WHERE r.kettle_id = $1 AND r.state IN ($2, $3, $4) FOR UPDATE OF r",
+		kettleId, RoundOffered, RoundCollecting, RoundBrewing, staleAfter.Seconds(),
+	).Scan(append(existing.scanFields(), &makerNickname, &stale)...)
+	var cancelled *Round
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		return Round{}, nil, err
+	case !takeOver || !stale:
+		return Round{}, nil, &KettleBusyError{Round: existing, MakerNickname: makerNickname}
+	default:
+		err := tx.QueryRow(ctx,
+			"UPDATE drink_rounds SET state = $2, updated_at = now(), finished_at = now() WHERE round_id = $1 RETURNING "+roundColumns,
+			existing.RoundId, RoundCancelled,
+		).Scan(existing.scanFields()...)
+		if err != nil {
+			return Round{}, nil, err
+		}
+		cancelled = &existing
+	}
+
+	var r Round
+	err = tx.QueryRow(ctx,
+		"INSERT INTO drink_rounds(kettle_id, maker_id, state) VALUES($1, $2, $3) RETURNING "+roundColumns,
+		kettleId, makerId, RoundOffered,
+	).Scan(r.scanFields()...)
+	if err != nil {
+		// shouldn't happen with the kettle row locked, but the partial unique index is the last line of defence
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+			return Round{}, nil, ErrRoundInProgress
+		}
+		return Round{}, nil, err
+	}
+	// current_maker is kept around as a cheap "is anyone making?" lookup for the kettle
+	if _, err := tx.Exec(ctx, "UPDATE kettles SET current_maker = $2 WHERE kettle_id = $1", kettleId, makerId); err != nil {
+		return Round{}, nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return Round{}, nil, err
+	}
+	return r, cancelled, nil
+}
+
+func (s *PostgresStore) GetRound(ctx context.Context, roundId uuid.UUID) (Round, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var r Round
+	err := s.pool.QueryRow(ctx, "SELECT "+roundColumns+" FROM drink_rounds WHERE round_id = $1", roundId).Scan(r.scanFields()...)
+	return r, notFound(err)
+}
+
+func (s *PostgresStore) GetActiveRound(ctx context.Context, kettleId uuid.UUID) (Round, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var r Round
+	err := s.pool.QueryRow(ctx,
+		"SELECT "+roundColumns+" FROM drink_rounds WHERE kettle_id = $1 AND state IN ($2, $3, $4)",
+		kettleId, RoundOffered, RoundCollecting, RoundBrewing,
+	).Scan(r.scanFields()...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Round{}, ErrNoActiveRound
+	}
+	return r, err
+}
+
+// Moves the round into a new state, rejecting anything not in roundTransitions.
+// The UPDATE is guarded on the state we read, so if somebody else moved the round in the meantime
+// we return ErrIllegalTransition rather than clobbering their change.
+func (s *PostgresStore) TransitionRound(ctx context.Context, r *Round, to RoundState) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if !r.State.CanTransitionTo(to) {
+		return ErrIllegalTransition
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var updated Round
+	err = tx.QueryRow(ctx,
+		"UPDATE drink_rounds SET state = $3, updated_at = now(), "+
+			"finished_at = CASE WHEN $4 THEN now() ELSE finished_at END "+
+			"WHERE round_id = $1 AND state = $2 RETURNING "+roundColumns,
+		r.RoundId, r.State, to, !to.IsActive(),
+	).Scan(updated.scanFields()...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrIllegalTransition
+	}
+	if err != nil {
+		return err
+	}
+	if !to.IsActive() {
+		if _, err := tx.Exec(ctx,
+			"UPDATE kettles SET current_maker = null WHERE kettle_id = $1 AND current_maker = $2",
+			r.KettleId, r.MakerId,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	*r = updated
+	return nil
+}
+
+// Active rounds offered before the cutoff. Used for expiring rounds the maker has forgotten about.
+func (s *PostgresStore) GetActiveRoundsOfferedBefore(ctx context.Context, before time.Time) ([]Round, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.queryRounds(ctx,
+		"SELECT "+roundColumns+" FROM drink_rounds WHERE state IN ($1, $2, $3) AND offered_at < $4",
+		RoundOffered, RoundCollecting, RoundBrewing, before,
+	)
+}
+
+// Active rounds offered before the cutoff whose maker hasn't been nudged yet.
+func (s *PostgresStore) GetRoundsNeedingReminder(ctx context.Context, before time.Time) ([]Round, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.queryRounds(ctx,
+		"SELECT "+roundColumns+" FROM drink_rounds WHERE state IN ($1, $2, $3) AND offered_at < $4 AND reminder_sent_at IS NULL",
+		RoundOffered, RoundCollecting, RoundBrewing, before,
+	)
+}
+
+// Returns false if the reminder was already marked as sent (i.e. someone else got there first), so the caller shouldn't send it again.
+func (s *PostgresStore) MarkReminderSent(ctx context.Context, r *Round) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err := s.pool.QueryRow(ctx,
+		"UPDATE drink_rounds SET reminder_sent_at = now() WHERE round_id = $1 AND reminder_sent_at IS NULL RETURNING reminder_sent_at",
+		r.RoundId,
+	).Scan(&r.ReminderSentAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *PostgresStore) queryRounds(ctx context.Context, query string, args ...interface{}) ([]Round, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rounds := make([]Round, 0)
+
+	for rows.Next() {
+		var r Round
+		if err := rows.Scan(r.scanFields()...); err != nil {
+			return nil, err
+		}
+		rounds = append(rounds, r)
+	}
+
+	return rounds, rows.Err()
+}
+
+// "a, b" -> "p.a, p.b" for when a query joins another table with clashing column names
+func prefixColumns(prefix, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, c := range cols {
+		cols[i] = prefix + "." + c
+	}
+	return strings.Join(cols, ", ")
+}
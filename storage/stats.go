@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	FavouriteDrinksLimit = 5
+	LeaderboardLimit     = 10
+)
+
+// Only counts what actually got made, see madeDrinksCte. Unlike the rota, your own drinks from your own rounds count.
+type UserStats struct {
+	CupsDrunk  int `json:"cupsDrunk"`
+	CupsMade   int `json:"cupsMade"`
+	RoundsMade int `json:"roundsMade"`
+	// most drunk first
+	FavouriteDrinks []DrinkCount `json:"favouriteDrinks"`
+	// rounds they made or drank from, by hour of the day they were offered
+	Hours []HourCount `json:"hours"`
+	// from offering to finishing, over rounds they made. nil if they haven't made any
+	AverageRoundSeconds *float64 `json:"averageRoundSeconds"`
+}
+
+type KettleStats struct {
+	Rounds int `json:"rounds"`
+	Cups   int `json:"cups"`
+	// how many different people have had a drink
+	Drinkers        int          `json:"drinkers"`
+	FavouriteDrinks []DrinkCount `json:"favouriteDrinks"`
+	// rounds by hour of the day they were offered
+	Hours               []HourCount `json:"hours"`
+	AverageRoundSeconds *float64    `json:"averageRoundSeconds"`
+	// most cups made (for anyone, themselves included) first
+	TopMakers []LeaderboardEntry `json:"topMakers"`
+	// most cups drunk first
+	TopDrinkers []LeaderboardEntry `json:"topDrinkers"`
+}
+
+type DrinkCount struct {
+	// e.g. "tea". free text orders are counted by their (lower cased) text
+	Drink string `json:"drink"`
+	Count int    `json:"count"`
+}
+
+type HourCount struct {
+	// 0-23
+	Hour   int `json:"hour"`
+	Rounds int `json:"rounds"`
+}
+
+type LeaderboardEntry struct {
+	UserId   uuid.UUID `json:"userId"`
+	Nickname string    `json:"nickname"`
+	Count    int       `json:"count"`
+}
+
+// what a drink is counted as in favourite drinks. keep in step with drinkLabel
+const drinkLabelSql = "COALESCE(replace(drink_order->>'drink', '_', ' '), lower(trim(choice)))"
+
+func drinkLabel(dr DrinkRequest) string {
+	if dr.Order != nil {
+		return dr.Order.Drink.Label()
+	}
+	return strings.ToLower(strings.TrimSpace(dr.Choice))
+}
+
+// all 24 hours, with the counts filled in
+func fillHours(counts map[int]int) []HourCount {
+	hours := make([]HourCount, 24)
+	for h := range hours {
+		hours[h] = HourCount{Hour: h, Rounds: counts[h]}
+	}
+	return hours
+}
+
+// Stats over everything since since (the zero time for all time). Hours are in loc.
+func (s *PostgresStore) GetUserStats(ctx context.Context, userId uuid.UUID, since time.Time, loc *time.Location) (UserStats, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	made := madeDrinksCte("r.offered_at >= $2 AND (dr.user_id = $1 OR r.maker_id = $1)")
+	stats := UserStats{}
+	err := s.pool.QueryRow(ctx,
+		"WITH "+made+" SELECT count(*) FILTER (WHERE user_id = $1), count(*) FILTER (WHERE maker_id = $1) FROM made",
+		userId, since,
+	).Scan(&stats.CupsDrunk, &stats.CupsMade)
+	if err != nil {
+		return stats, err
+	}
+	err = s.pool.QueryRow(ctx,
+		"SELECT count(*), avg(extract(epoch FROM finished_at - offered_at))::float8 FROM drink_rounds "+
+			"WHERE maker_id = $1 AND state = 'delivered' AND offered_at >= $2",
+		userId, since,
+	).Scan(&stats.RoundsMade, &stats.AverageRoundSeconds)
+	if err != nil {
+		return stats, err
+	}
+	if stats.FavouriteDrinks, err = s.queryDrinkCounts(ctx,
+		"WITH "+made+" SELECT "+drinkLabelSql+", count(*) FROM made WHERE user_id = $1 GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT $3",
+		userId, since, FavouriteDrinksLimit,
+	); err != nil {
+		return stats, err
+	}
+	stats.Hours, err = s.queryHours(ctx,
+		"WITH "+made+" SELECT extract(hour FROM offered_at AT TIME ZONE $3)::int, count(DISTINCT round_id) FROM made GROUP BY 1",
+		userId, since, loc.String(),
+	)
+	return stats, err
+}
+
+// Stats over everything since since (the zero time for all time). Hours are in loc.
+func (s *PostgresStore) GetKettleStats(ctx context.Context, kettleId uuid.UUID, since time.Time, loc *time.Location) (KettleStats, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	made := madeDrinksCte("r.kettle_id = $1 AND r.offered_at >= $2")
+	stats := KettleStats{}
+	err := s.pool.QueryRow(ctx,
+		"SELECT count(*), avg(extract(epoch FROM finished_at - offered_at))::float8 FROM drink_rounds "+
+			"WHERE kettle_id = $1 AND state = 'delivered' AND offered_at >= $2",
+		kettleId, since,
+	).Scan(&stats.Rounds, &stats.AverageRoundSeconds)
+	if err != nil {
+		return stats, err
+	}
+	err = s.pool.QueryRow(ctx,
+		"WITH "+made+" SELECT count(*), count(DISTINCT user_id) FROM made",
+		kettleId, since,
+	).Scan(&stats.Cups, &stats.Drinkers)
+	if err != nil {
+		return stats, err
+	}
+	if stats.FavouriteDrinks, err = s.queryDrinkCounts(ctx,
+		"WITH "+made+" SELECT "+drinkLabelSql+", count(*) FROM made GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT $3",
+		kettleId, since, FavouriteDrinksLimit,
+	); err != nil {
+		return stats, err
+	}
+	if stats.Hours, err = s.queryHours(ctx,
+		"SELECT extract(hour FROM offered_at AT TIME ZONE $3)::int, count(*) FROM drink_rounds "+
+			"WHERE kettle_id = $1 AND state = 'delivered' AND offered_at >= $2 GROUP BY 1",
+		kettleId, since, loc.String(),
+	); err != nil {
+		return stats, err
+	}
+	if stats.TopMakers, err = s.queryLeaderboard(ctx,
+		"WITH "+made+" SELECT m.maker_id, u.default_nickname, count(*) FROM made m JOIN appusers u ON u.user_id = m.maker_id "+
+			"GROUP BY 1, 2 ORDER BY 3 DESC, 2 LIMIT $3",
+		kettleId, since, LeaderboardLimit,
+	); err != nil {
+		return stats, err
+	}
+	stats.TopDrinkers, err = s.queryLeaderboard(ctx,
+		"WITH "+made+" SELECT m.user_id, u.default_nickname, count(*) FROM made m JOIN appusers u ON u.user_id = m.user_id "+
+			"GROUP BY 1, 2 ORDER BY 3 DESC, 2 LIMIT $3",
+		kettleId, since, LeaderboardLimit,
+	)
+	return stats, err
+}
+
+// query must select the label then the count
+func (s *PostgresStore) queryDrinkCounts(ctx context.Context, query string, args ...interface{}) ([]DrinkCount, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]DrinkCount, 0)
+
+	for rows.Next() {
+		var c DrinkCount
+		if err := rows.Scan(&c.Drink, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+// query must select the hour then the count
+func (s *PostgresStore) queryHours(ctx context.Context, query string, args ...interface{}) ([]HourCount, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+
+	for rows.Next() {
+		var hour, count int
+		if err := rows.Scan(&hour, &count); err != nil {
+			return nil, err
+		}
+		counts[hour] = count
+	}
+
+	return fillHours(counts), rows.Err()
+}
+
+// query must select user_id, nickname then the count
+func (s *PostgresStore) queryLeaderboard(ctx context.Context, query string, args ...interface{}) ([]LeaderboardEntry, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	board := make([]LeaderboardEntry, 0)
+
+	for rows.Next() {
+		var e LeaderboardEntry
+		if err := rows.Scan(&e.UserId, &e.Nickname, &e.Count); err != nil {
+			return nil, err
+		}
+		board = append(board, e)
+	}
+
+	return board, rows.Err()
+}
+
+// most first, ties alphabetically, cut down to limit
+func topDrinkCounts(counts map[string]int, limit int) []DrinkCount {
+	top := make([]DrinkCount, 0, len(counts))
+	for drink, count := range counts {
+		top = append(top, DrinkCount{Drink: drink, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Drink < top[j].Drink
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Returned by single-row lookups (GetUser, GetKettle etc.) when there's nothing there
+var ErrNotFound = errors.New("not found")
+
+// Everything the app needs to persist. PostgresStore is the real thing,
+// MemoryStore is a pure-Go stand-in so the app can run without a PostGIS server.
+type Store interface {
+	// Creates the user if u.UserId is zero, otherwise updates them (ErrNotFound if they don't exist).
+	// Empty nickname/usual or a zero location leave what's already there alone.
+	UpsertUser(ctx context.Context, u *User) (uuid.UUID, error)
+	GetUser(ctx context.Context, userId uuid.UUID) (User, error)
+	// Owner of the device with this token
+	GetUserIdFromToken(ctx context.Context, firebaseToken string) (uuid.UUID, error)
+	GetUsersWithinRadius(ctx context.Context, long, lat float64, metreRadius int32) ([]User, error)
+
+	// Adds the token as one of d.UserId's devices. Re-registering one of their own tokens makes it count as valid
+	// again. ErrDeviceTaken if the token is registered to someone else, it never silently changes hands.
+	RegisterDevice(ctx context.Context, d *Device) error
+	// Returns false if the user has no such device
+	RemoveDevice(ctx context.Context, userId, deviceId uuid.UUID) (bool, error)
+	GetUserDevices(ctx context.Context, userId uuid.UUID) ([]Device, error)
+	// Devices notifications for these users should go to, i.e. without the dead ones
+	GetNotifiableDevices(ctx context.Context, userIds []uuid.UUID) ([]Device, error)
+	// Marks the token dead (FCM says the app's gone) so nothing more is sent to it. Registering it again clears that.
+	// Returns false if no device has the token or it was already marked.
+	InvalidateFirebaseToken(ctx context.Context, firebaseToken string) (bool, error)
+
+	// Creates the kettle, or updates the one with the same wireless id. Only members can update,
+	// anyone else gets ErrNotKettleMember. userId isn't made a member, that's up to the caller.
+	UpsertKettle(ctx context.Context, k *Kettle, userId uuid.UUID) (uuid.UUID, error)
+	GetKettle(ctx context.Context, kettleId uuid.UUID) (Kettle, error)
+	GetKettlesWithinRadius(ctx context.Context, long, lat float64, metreRadius int32) ([]Kettle, error)
+
+	// Joining a kettle you're already a member of is a no-op
+	AddKettleMember(ctx context.Context, kettleId, userId uuid.UUID) error
+	// Returns false if they weren't a member in the first place
+	RemoveKettleMember(ctx context.Context, kettleId, userId uuid.UUID) (bool, error)
+	GetKettleMembers(ctx context.Context, kettleId uuid.UUID) ([]KettleMember, error)
+	IsKettleMember(ctx context.Context, kettleId, userId uuid.UUID) (bool, error)
+	// Whether the user was last seen within metreRadius of the kettle. false if we don't know where they are
+	IsUserNearKettle(ctx context.Context, kettleId, userId uuid.UUID, metreRadius int32) (bool, error)
+	// Everyone who should hear about an offer on this kettle, depending on its NotifyMode
+	GetOfferRecipients(ctx context.Context, k Kettle, metreRadius int32) ([]User, error)
+
+	// Every member's cups made/drunk, whoever's turn it is to make first
+	GetKettleRota(ctx context.Context, kettleId uuid.UUID) ([]RotaEntry, error)
+	// Returns false if the kettle's members were already nudged after notBefore, so nobody should be nudged again yet.
+	MarkKettleNudged(ctx context.Context, kettleId uuid.UUID, notBefore time.Time) (bool, error)
+
+	// Stats over everything since since (the zero time for all time). Hours are in loc.
+	GetUserStats(ctx context.Context, userId uuid.UUID, since time.Time, loc *time.Location) (UserStats, error)
+	GetKettleStats(ctx context.Context, kettleId uuid.UUID, since time.Time, loc *time.Location) (KettleStats, error)
+
+	// Empty if the kettle hasn't set one, in which case anything goes
+	GetKettleMenu(ctx context.Context, kettleId uuid.UUID) (Menu, error)
+	// Replaces the kettle's whole menu. Items that were already on it keep their stock flag unless it's changed.
+	SetKettleMenu(ctx context.Context, kettleId, updatedBy uuid.UUID, menu Menu) error
+	// Marks something on the menu as run out (or back in). ErrNotFound if it isn't on the kettle's menu.
+	SetMenuItemStock(ctx context.Context, kettleId, updatedBy uuid.UUID, kind MenuKind, item string, inStock bool) (MenuItem, error)
+
+	// Atomically makes makerId the kettle's current maker and starts a new round.
+	// Fails with *KettleBusyError if there's already an active round, unless takeOver is set and the round
+	// hasn't been updated for staleAfter (0 for any round), in which case the existing round is cancelled and replaced.
+	// The cancelled round is returned too, nil if there wasn't one.
+	ClaimKettle(ctx context.Context, kettleId, makerId uuid.UUID, takeOver bool, staleAfter time.Duration) (Round, *Round, error)
+	GetRound(ctx context.Context, roundId uuid.UUID) (Round, error)
+	// ErrNoActiveRound if nobody is making
+	GetActiveRound(ctx context.Context, kettleId uuid.UUID) (Round, error)
+	// Moves the round into a new state, ErrIllegalTransition if it's not allowed from the state r was read in
+	// (including if someone else has moved it on since). r is updated on success.
+	TransitionRound(ctx context.Context, r *Round, to RoundState) error
+	GetActiveRoundsOfferedBefore(ctx context.Context, before time.Time) ([]Round, error)
+	GetRoundsNeedingReminder(ctx context.Context, before time.Time) ([]Round, error)
+	// Returns false if the reminder was already marked as sent, so the caller shouldn't send it again.
+	MarkReminderSent(ctx context.Context, r *Round) (bool, error)
+
+	// If the user already asked for something this round, their order is replaced. ErrRoundClosed if the round
+	// isn't taking orders any more.
+	UpsertDrinkRequest(ctx context.Context, dr *DrinkRequest) (uuid.UUID, error)
+	GetRoundDrinkRequests(ctx context.Context, roundId uuid.UUID) ([]DrinkRequest, error)
+	// Ticks the drink off as made (or unticks it). ErrNotFound if the round has no such request.
+	SetDrinkRequestDone(ctx context.Context, roundId, requestId uuid.UUID, done bool) error
+
+	// Queues push notifications for the outbox workers, filling in their ids.
+	EnqueueNotifications(ctx context.Context, ns []OutboxNotification) error
+	// Up to limit due notifications. Each is held back from other callers for lease while it's being sent
+	// (if the sender dies it gets retried after that), and has its attempts bumped.
+	ClaimDueNotifications(ctx context.Context, limit int, lease time.Duration) ([]OutboxNotification, error)
+	// Takes the lease again right before the notifications are sent, and returns the ones it could. A claimed
+	// notification that's already been claimed again by someone else (its lease ran out while it was waiting) is left out
+	RenewNotificationLease(ctx context.Context, ns []OutboxNotification, lease time.Duration) ([]OutboxNotification, error)
+	MarkNotificationSent(ctx context.Context, notificationId uuid.UUID) error
+	// Retried at retryAt, or marked failed for good if retryAt is nil
+	MarkNotificationFailed(ctx context.Context, notificationId uuid.UUID, lastError string, retryAt *time.Time) error
+
+	// Checks the database is reachable. For /health/ready
+	Ping(ctx context.Context) error
+	// Version of the PostGIS library the radius queries rely on. Empty for stores that don't use PostGIS.
+	PostGISVersion(ctx context.Context) (string, error)
+}
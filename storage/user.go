@@ -1,7 +1,7 @@
 package storage
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 
 	"github.com/google/uuid"
@@ -9,69 +9,85 @@ import (
 
 type User struct {
 	UserId          uuid.UUID
-	FirebaseToken   string
 	DefaultNickname string
 	TheUsual        string
-	LastKnownLong   float64
-	LastKnownLat    float64
+	// nil if the usual is free text from an old app version
+	TheUsualOrder *DrinkOrder
+	LastKnownLong float64
+	LastKnownLat  float64
 }
 
-func (u *User) CreateUser(db *sql.DB) (uuid.UUID, error) {
-	// //https://stackoverflow.com/a/47396542 for geolocation
-	err := db.QueryRow(
-		"INSERT INTO appusers(firebase_token, default_nickname, the_usual, last_known_location) "+
-			"VALUES($1, $2, $3, $4) RETURNING user_id",
-		u.FirebaseToken, u.DefaultNickname, u.TheUsual, fmt.Sprintf("POINT(%f %f)", u.LastKnownLong, u.LastKnownLat),
-	).Scan(&u.UserId)
-	if err != nil {
-		return uuid.UUID{}, err
+// Creates the user if u.UserId is zero, otherwise updates them (ErrNotFound if there's no such user).
+// When updating, an empty nickname/usual or a zero location leaves what's already there alone.
+// A free text usual with no TheUsualOrder replaces any structured one.
+func (s *PostgresStore) UpsertUser(ctx context.Context, u *User) (uuid.UUID, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	location := fmt.Sprintf("POINT(%f %f)", u.LastKnownLong, u.LastKnownLat)
+	if u.UserId == uuid.Nil {
+		err := s.pool.QueryRow(ctx,
+			"INSERT INTO appusers(default_nickname, the_usual, the_usual_order, last_known_location) VALUES($1, $2, $3, $4) RETURNING user_id",
+			u.DefaultNickname, u.TheUsual, u.TheUsualOrder, location,
+		).Scan(&u.UserId)
+		if err != nil {
+			return uuid.UUID{}, err
+		}
+		return u.UserId, nil
 	}
 
-	return u.UserId, nil
-}
-
-// Creates new user if doesn't exist (no matching firebase-token). Or just updates existing users location
-func (u *User) UpsertUser(db *sql.DB) (uuid.UUID, error) {
-	setLastKnowLocationFragment := "SET "
+	args := []interface{}{u.UserId, u.DefaultNickname, u.TheUsual, u.TheUsualOrder}
+	setLastKnowLocationFragment := ""
+	// only passed when it's used. postgres can't work out the type of a parameter nothing refers to
 	if u.LastKnownLat != 0.0 || u.LastKnownLong != 0.0 {
-		setLastKnowLocationFragment = "SET last_known_location=EXCLUDED.last_known_location,"
+		setLastKnowLocationFragment = ", last_known_location=$5"
+		args = append(args, location)
 	}
-	err := db.QueryRow(
-		"INSERT INTO appusers(firebase_token, default_nickname, the_usual, last_known_location) "+
-			"VALUES($1, $2, $3, $4) "+
-			"ON CONFLICT(firebase_token) DO UPDATE "+
-			setLastKnowLocationFragment+
+	var userId uuid.UUID
+	err := s.pool.QueryRow(ctx,
+		"UPDATE appusers SET "+
 			// this coalesce with nullif, will basically update the column if the update-value is non-null AND not-empty-string
-			"default_nickname=COALESCE(NULLIF(EXCLUDED.default_nickname,''), appusers.default_nickname),"+
-			"the_usual=COALESCE(NULLIF(EXCLUDED.the_usual,''), appusers.the_usual) "+
-			"RETURNING user_id",
-		u.FirebaseToken, u.DefaultNickname, u.TheUsual, fmt.Sprintf("POINT(%f %f)", u.LastKnownLong, u.LastKnownLat),
-	).Scan(&u.UserId)
+			"default_nickname=COALESCE(NULLIF($2,''), default_nickname),"+
+			"the_usual=COALESCE(NULLIF($3,''), the_usual),"+
+			"the_usual_order=CASE WHEN $4::jsonb IS NOT NULL THEN $4 WHEN $3 <> '' THEN NULL ELSE the_usual_order END"+
+			setLastKnowLocationFragment+
+			" WHERE user_id = $1 RETURNING user_id",
+		args...,
+	).Scan(&userId)
 	if err != nil {
-		return uuid.UUID{}, err
+		return uuid.UUID{}, notFound(err)
 	}
-
-	return u.UserId, nil
+	return userId, nil
 }
 
-func GetUser(db *sql.DB, userId uuid.UUID) (User, error) {
+func (s *PostgresStore) GetUser(ctx context.Context, userId uuid.UUID) (User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	var user User
-	err := db.QueryRow("SELECT user_id, firebase_token, the_usual, default_nickname FROM appusers"+
-		" WHERE user_id = $1", userId).Scan(&user.UserId, &user.FirebaseToken, &user.TheUsual, &user.DefaultNickname)
-	return user, err
+	err := s.pool.QueryRow(ctx, "SELECT user_id, the_usual, the_usual_order, default_nickname FROM appusers"+
+		" WHERE user_id = $1", userId).Scan(&user.UserId, &user.TheUsual, &user.TheUsualOrder, &user.DefaultNickname)
+	return user, notFound(err)
 }
 
-func GetUserIdFromToken(db *sql.DB, firebaseToken string) (uuid.UUID, error) {
+// Whoever has a device with this token
+func (s *PostgresStore) GetUserIdFromToken(ctx context.Context, firebaseToken string) (uuid.UUID, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
 	var userId uuid.UUID
-	err := db.QueryRow("SELECT user_id from appusers WHERE firebase_token = $1", firebaseToken).Scan(&userId)
-	return userId, err
+	err := s.pool.QueryRow(ctx, "SELECT user_id from user_devices WHERE firebase_token = $1", firebaseToken).Scan(&userId)
+	return userId, notFound(err)
 }
 
-func GetUsersWithinRadius(db *sql.DB, long, lat float64, metreRadius int32) ([]User, error) {
-
-	rows, err := db.Query(
-		"SELECT user_id, firebase_token, default_nickname, the_usual FROM appusers WHERE ST_DWithin(last_known_location, ST_MakePoint($1,$2)::geography, $3)", long, lat, metreRadius,
+func (s *PostgresStore) GetUsersWithinRadius(ctx context.Context, long, lat float64, metreRadius int32) ([]User, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.queryUsers(ctx,
+		"SELECT user_id, default_nickname, the_usual, the_usual_order FROM appusers WHERE ST_DWithin(last_known_location, ST_MakePoint($1,$2)::geography, $3)", long, lat, metreRadius,
 	)
+}
+
+// query must select user_id, default_nickname, the_usual, the_usual_order in that order
+func (s *PostgresStore) queryUsers(ctx context.Context, query string, args ...interface{}) ([]User, error) {
+	rows, err := s.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -81,7 +97,7 @@ func GetUsersWithinRadius(db *sql.DB, long, lat float64, metreRadius int32) ([]U
 
 	for rows.Next() {
 		var r User
-		if err := rows.Scan(&r.UserId, &r.FirebaseToken, &r.DefaultNickname, &r.TheUsual); err != nil {
+		if err := rows.Scan(&r.UserId, &r.DefaultNickname, &r.TheUsual, &r.TheUsualOrder); err != nil {
 			return nil, err
 		}
 		users = append(users, r)
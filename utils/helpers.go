@@ -36,3 +36,12 @@ func JSONResponse(lgr *zap.Logger, w http.ResponseWriter, code int, payload inte
 		lgr.Error("error writing response:", zap.Error(err))
 	}
 }
+
+// For things meant to be read (or pasted) as-is rather than parsed, e.g. the brew sheet
+func TextResponse(lgr *zap.Logger, w http.ResponseWriter, code int, text string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if _, err := w.Write([]byte(text)); err != nil {
+		lgr.Error("error writing response:", zap.Error(err))
+	}
+}